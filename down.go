@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/supervisor"
+)
+
+const (
+	downPollInterval = time.Millisecond * 50
+	downExitTimeout  = time.Second * 10
+)
+
+func down(path string, args []string) error {
+	flags := flag.NewFlagSet("down", flag.ExitOnError)
+	timeout := flags.Duration("t", 0, "overall shutdown timeout (e.g. 30s), after which remaining services are killed")
+	_ = flags.Parse(args)
+
+	stateDir, err := supervisor.StateDir(path)
+	if err != nil {
+		return err
+	}
+
+	state, err := supervisor.ReadState(stateDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("not running (no live supervisor state in %v)", stateDir)
+		}
+
+		return err
+	}
+
+	client, err := supervisor.NewClient(path)
+	if err != nil {
+		return err
+	}
+
+	stopReport, err := client.Down(*timeout)
+	if err != nil {
+		return err
+	}
+
+	for _, tier := range stopReport.Tiers {
+		_, _ = fmt.Fprintf(os.Stdout, "stopped %v\n", strings.Join(tier, ", "))
+	}
+
+	if len(stopReport.ForceKilled) > 0 {
+		_, _ = fmt.Fprintf(os.Stdout, "killed %v (timed out)\n", strings.Join(stopReport.ForceKilled, ", "))
+	}
+
+	// wait for the supervisor itself to go away, so that an immediate "up" doesn't find it still holding the lock
+	deadline := time.Now().Add(downExitTimeout)
+	for state.Alive() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for supervisor pid %v to exit", state.PID)
+		}
+
+		time.Sleep(downPollInterval)
+	}
+
+	return nil
+}
@@ -1,18 +1,87 @@
 package internal
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
+	"sync"
 )
 
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+var (
+	// shared by every logger, so that a change of level applies to those already handed out
+	level    = new(slog.LevelVar)
+	formatMu = new(sync.Mutex)
+	format   = TextFormat
+)
+
+func init() {
+	level.Set(slog.LevelInfo)
+}
+
+// SetFormat sets the format (text or json) for the loggers handed out from now on
+func SetFormat(newFormat string) error {
+	if newFormat != TextFormat && newFormat != JSONFormat {
+		return fmt.Errorf("unknown log format %#+v; must be one of text or json", newFormat)
+	}
+
+	formatMu.Lock()
+	defer formatMu.Unlock()
+
+	format = newFormat
+
+	return nil
+}
+
+// GetFormat returns the format for the loggers handed out from now on
+func GetFormat() string {
+	formatMu.Lock()
+	defer formatMu.Unlock()
+
+	return format
+}
+
+// SetLevel sets the level (debug, info, warn or error) for all loggers
+func SetLevel(newLevel string) error {
+	l := slog.LevelInfo
+
+	err := l.UnmarshalText([]byte(strings.ToUpper(newLevel)))
+	if err != nil {
+		return fmt.Errorf("unknown log level %#+v; must be one of debug, info, warn or error", newLevel)
+	}
+
+	level.Set(l)
+
+	return nil
+}
+
+// GetLevel returns the level for all loggers
+func GetLevel() string {
+	return strings.ToLower(level.Level().String())
+}
+
 func GetLogger(name string) *slog.Logger {
-	h := slog.NewTextHandler(
-		os.Stderr,
-		&slog.HandlerOptions{
-			AddSource: true,
-			Level:     slog.LevelDebug,
-		},
-	)
+	formatMu.Lock()
+	currentFormat := format
+	formatMu.Unlock()
+
+	options := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+	}
+
+	var h slog.Handler
+
+	if currentFormat == JSONFormat {
+		h = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, options)
+	}
 
 	l := slog.New(h).With("logger", name)
 
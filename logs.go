@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/control"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/logstore"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/supervisor"
+)
+
+var (
+	// the same cycle of colours as docker compose
+	colors = []string{
+		"36", "33", "32", "35", "34",
+		"36;1", "33;1", "32;1", "35;1", "34;1",
+	}
+)
+
+// logPrinter prefixes each line of each log with its (padded, optionally coloured) service name
+type logPrinter struct {
+	w           io.Writer
+	width       int
+	colorByName map[string]string
+	noColor     bool
+}
+
+func newLogPrinter(w io.Writer, names []string, noColor bool) *logPrinter {
+	p := logPrinter{
+		w:           w,
+		colorByName: make(map[string]string),
+		noColor:     noColor,
+	}
+
+	for i, name := range names {
+		if len(name) > p.width {
+			p.width = len(name)
+		}
+
+		p.colorByName[name] = colors[i%len(colors)]
+	}
+
+	return &p
+}
+
+func (p *logPrinter) prefix(name string) string {
+	padded := fmt.Sprintf("%-*v |", p.width, name)
+
+	color, ok := p.colorByName[name]
+	if p.noColor || !ok {
+		return padded
+	}
+
+	return fmt.Sprintf("\033[%vm%v\033[0m", color, padded)
+}
+
+func (p *logPrinter) print(l managed_process.Log) {
+	for _, line := range bytes.SplitAfter(l.Data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+
+		_, _ = fmt.Fprintf(p.w, "%v %s", p.prefix(l.Name), line)
+	}
+}
+
+// jsonLog is what's written out for each log by jsonLogPrinter
+type jsonLog struct {
+	Service   string `json:"service"`
+	Stream    string `json:"stream"`
+	Timestamp string `json:"timestamp"`
+	Seq       uint64 `json:"seq"`
+	Line      string `json:"line"`
+}
+
+// jsonLogPrinter writes each log as a JSON object on a line of its own (e.g. for jq or a log shipper)
+type jsonLogPrinter struct {
+	encoder *json.Encoder
+}
+
+func newJSONLogPrinter(w io.Writer) *jsonLogPrinter {
+	p := jsonLogPrinter{
+		encoder: json.NewEncoder(w),
+	}
+
+	// the lines are service output, not bound for a web page, so they're best left as they are
+	p.encoder.SetEscapeHTML(false)
+
+	return &p
+}
+
+func (p *jsonLogPrinter) print(l managed_process.Log) {
+	stream := "stdout"
+	if l.IsStderr {
+		stream = "stderr"
+	}
+
+	_ = p.encoder.Encode(
+		jsonLog{
+			Service:   l.Name,
+			Stream:    stream,
+			Timestamp: time.UnixMilli(l.Timestamp).UTC().Format(time.RFC3339Nano),
+			Seq:       l.Seq,
+			Line:      strings.TrimSuffix(string(l.Data), "\n"),
+		},
+	)
+}
+
+type printer interface {
+	print(l managed_process.Log)
+}
+
+func newPrinter(format string, names []string, noColor bool) printer {
+	if format == "json" {
+		return newJSONLogPrinter(os.Stdout)
+	}
+
+	return newLogPrinter(os.Stdout, names, noColor || !isTerminal(os.Stdout))
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// parseTimestamp accepts an RFC3339 timestamp, a unix timestamp in seconds or a duration relative to now (e.g. "10m")
+func parseTimestamp(raw string, now time.Time) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err == nil {
+		return t.UnixMilli(), nil
+	}
+
+	seconds, err := strconv.ParseInt(raw, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0).UnixMilli(), nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err == nil {
+		return now.Add(-d).UnixMilli(), nil
+	}
+
+	return 0, fmt.Errorf("failed to parse %#+v as an RFC3339 timestamp, unix timestamp or relative duration", raw)
+}
+
+func parseTail(raw string) (int, error) {
+	if raw == "all" {
+		return 0, nil
+	}
+
+	tail, err := strconv.Atoi(raw)
+	if err != nil || tail < 0 {
+		return 0, fmt.Errorf("--tail must be \"all\" or a non-negative number, not %#+v", raw)
+	}
+
+	// 0 means all as far as the protocol goes
+	if tail == 0 {
+		return -1, nil
+	}
+
+	return tail, nil
+}
+
+func logs(path string, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "follow log output")
+	tail := flags.String("tail", "all", "number of lines to show from the end of the logs for each service")
+	since := flags.String("since", "", "show logs since timestamp (e.g. 2013-01-02T13:23:37Z) or relative (e.g. 42m)")
+	until := flags.String("until", "", "show logs before timestamp (e.g. 2013-01-02T13:23:37Z) or relative (e.g. 42m)")
+	noColor := flags.Bool("no-color", false, "produce monochrome output")
+	format := flags.String("format", "text", "output format (text or json, the latter being a JSON object per line)")
+	policy := flags.String(
+		"policy",
+		string(fanout.DropNewest),
+		"what to do when following and not keeping up (drop-newest, drop-oldest, block or spill-to-disk)",
+	)
+
+	_ = flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("--format must be \"text\" or \"json\", not %#+v", *format)
+	}
+
+	now := time.Now()
+
+	options := control.LogsOptions{
+		Follow: *follow,
+	}
+
+	var err error
+
+	options.Policy, err = fanout.ParsePolicy(*policy)
+	if err != nil {
+		return err
+	}
+
+	options.Tail, err = parseTail(*tail)
+	if err != nil {
+		return err
+	}
+
+	options.Since, err = parseTimestamp(*since, now)
+	if err != nil {
+		return err
+	}
+
+	options.Until, err = parseTimestamp(*until, now)
+	if err != nil {
+		return err
+	}
+
+	stateDir, err := supervisor.StateDir(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = supervisor.ReadState(stateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return storedLogs(path, options, *format, *noColor, flags.Args())
+	}
+
+	client, err := supervisor.NewClient(path)
+	if err != nil {
+		return err
+	}
+
+	serviceStatuses, err := client.Services()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	for _, serviceStatus := range serviceStatuses {
+		names = append(names, serviceStatus.Name)
+	}
+
+	printer := newPrinter(*format, names, *noColor)
+
+	stream, cancel, err := client.Logs(options, flags.Args()...)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for l := range stream {
+		printer.print(l)
+	}
+
+	return nil
+}
+
+// storedLogs shows the logs left behind in the log store when nothing is running (so there's nothing to follow)
+func storedLogs(path string, options control.LogsOptions, format string, noColor bool, names []string) error {
+	logDir, err := supervisor.LogDir(path)
+	if err != nil {
+		return err
+	}
+
+	storedNames, err := logstore.Names(logDir)
+	if err != nil {
+		return err
+	}
+
+	if len(storedNames) == 0 {
+		return fmt.Errorf("not running and no logs in %v", logDir)
+	}
+
+	for _, name := range names {
+		if !slices.Contains(storedNames, name) {
+			return fmt.Errorf("no logs for service %#+v", name)
+		}
+	}
+
+	if options.Tail < 0 {
+		return nil
+	}
+
+	storedLogs, err := logstore.Read(
+		logDir,
+		names,
+		logstore.Query{Since: options.Since, Until: options.Until, Tail: options.Tail},
+	)
+	if err != nil {
+		return err
+	}
+
+	printer := newPrinter(format, storedNames, noColor)
+
+	for _, l := range storedLogs {
+		printer.print(l)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogs(t *testing.T) {
+	t.Run("ParseTail", func(t *testing.T) {
+		for _, c := range []struct {
+			raw  string
+			tail int
+			err  bool
+		}{
+			{raw: "all", tail: 0},
+			{raw: "0", tail: -1}, // nothing at all, which the protocol can't otherwise tell apart from all
+			{raw: "1", tail: 1},
+			{raw: "100", tail: 100},
+			{raw: "-1", err: true},
+			{raw: "", err: true},
+			{raw: "ALL", err: true},
+			{raw: "1.5", err: true},
+			{raw: " 5", err: true},
+			{raw: "ten", err: true},
+		} {
+			tail, err := parseTail(c.raw)
+			if c.err {
+				require.Error(t, err, c.raw)
+				continue
+			}
+
+			require.NoError(t, err, c.raw)
+			require.Equal(t, c.tail, tail, c.raw)
+		}
+	})
+
+	t.Run("ParseTimestamp", func(t *testing.T) {
+		now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		for _, c := range []struct {
+			raw       string
+			timestamp int64
+			err       bool
+		}{
+			{raw: "", timestamp: 0},
+			{raw: "2013-01-02T13:23:37Z", timestamp: time.Date(2013, 1, 2, 13, 23, 37, 0, time.UTC).UnixMilli()},
+			{raw: "2013-01-02T13:23:37.123Z", timestamp: time.Date(2013, 1, 2, 13, 23, 37, 0, time.UTC).UnixMilli() + 123},
+			{raw: "2013-01-02T23:23:37+10:00", timestamp: time.Date(2013, 1, 2, 13, 23, 37, 0, time.UTC).UnixMilli()},
+			{raw: "1700000000", timestamp: 1700000000000},
+			{raw: "0", timestamp: 0},
+			{raw: "10m", timestamp: now.Add(-time.Minute * 10).UnixMilli()},
+			{raw: "1h30m", timestamp: now.Add(-time.Minute * 90).UnixMilli()},
+			{raw: "0s", timestamp: now.UnixMilli()},
+			{raw: "-5m", timestamp: now.Add(time.Minute * 5).UnixMilli()},
+			{raw: "2013-01-02", err: true},
+			{raw: "2013-01-02 13:23:37", err: true},
+			{raw: "1.5", err: true},
+			{raw: "10x", err: true},
+			{raw: "yesterday", err: true},
+		} {
+			timestamp, err := parseTimestamp(c.raw, now)
+			if c.err {
+				require.Error(t, err, c.raw)
+				continue
+			}
+
+			require.NoError(t, err, c.raw)
+			require.Equal(t, c.timestamp, timestamp, c.raw)
+		}
+	})
+
+	t.Run("JSONLogPrinter", func(t *testing.T) {
+		for _, c := range []struct {
+			l    managed_process.Log
+			line string
+		}{
+			{
+				l: managed_process.Log{
+					Name:      "api",
+					IsStdout:  true,
+					Timestamp: 1700000000123,
+					Seq:       1,
+					Data:      []byte("listening on :8080\n"),
+				},
+				line: `{"service":"api","stream":"stdout","timestamp":"2023-11-14T22:13:20.123Z","seq":1,` +
+					`"line":"listening on :8080"}`,
+			},
+			{
+				l: managed_process.Log{
+					Name:      "api",
+					IsStderr:  true,
+					Timestamp: 1700000000000,
+					Seq:       2,
+					Data:      []byte("error: \"oops\"\n"),
+				},
+				line: `{"service":"api","stream":"stderr","timestamp":"2023-11-14T22:13:20Z","seq":2,` +
+					`"line":"error: \"oops\""}`,
+			},
+			{
+				// part of a line, so without a newline to trim
+				l: managed_process.Log{
+					Name:      "db/primary",
+					IsStdout:  true,
+					Timestamp: 0,
+					Seq:       3,
+					Data:      []byte("partial <line> & more"),
+				},
+				line: `{"service":"db/primary","stream":"stdout","timestamp":"1970-01-01T00:00:00Z","seq":3,` +
+					`"line":"partial <line> & more"}`,
+			},
+			{
+				// only the one trailing newline is trimmed, and an empty line is still a line
+				l: managed_process.Log{
+					Name:     "api",
+					IsStdout: true,
+					Seq:      4,
+					Data:     []byte("\n\n"),
+				},
+				line: `{"service":"api","stream":"stdout","timestamp":"1970-01-01T00:00:00Z","seq":4,"line":"\n"}`,
+			},
+		} {
+			b := bytes.NewBuffer(nil)
+
+			newJSONLogPrinter(b).print(c.l)
+
+			require.Equal(t, c.line+"\n", b.String())
+		}
+	})
+}
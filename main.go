@@ -1,23 +1,60 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
-	"strings"
+
+	"github.com/initialed85/dspo/internal"
+	"github.com/initialed85/dspo/pkg/config"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("missing verb")
+	flags := flag.NewFlagSet("dspo", flag.ExitOnError)
+	path := flags.String("f", config.DefaultPath, "path to the service file")
+	logFormat := flags.String("log-format", internal.TextFormat, "format for dspo's own logs (text or json)")
+	logLevel := flags.String("log-level", internal.GetLevel(), "level for dspo's own logs (debug, info, warn or error)")
+	_ = flags.Parse(os.Args[1:])
+
+	err := internal.SetFormat(*logFormat)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	verb := os.Args[1]
+	err = internal.SetLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if verb == "run" {
-		command := strings.Join(os.Args[2:], " ")
+	if flags.NArg() < 1 {
+		log.Fatal("missing verb")
+	}
+
+	verb := flags.Arg(0)
+	args := flags.Args()[1:]
 
-		_ = command
-	} else {
+	switch verb {
+	case "up":
+		err = up(*path, args)
+	case "supervise":
+		err = supervise(*path, args)
+	case "down":
+		err = down(*path, args)
+	case "ps":
+		err = ps(*path, args)
+	case "logs":
+		err = logs(*path, args)
+	case "start":
+		err = start(*path, args)
+	case "stop":
+		err = stop(*path, args)
+	case "restart":
+		err = restart(*path, args)
+	default:
 		log.Fatalf("unknown verb: %s", verb)
 	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
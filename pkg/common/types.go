@@ -1,30 +1,99 @@
 package common
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
 )
 
-type ManagedProcessArgs struct {
-	RestartPolicy       managed_process.RestartPolicy
-	Shell               string
-	Command             string
-	Env                 []string
-	InheritEnv          bool
-	RestartWaitDuration time.Duration
+// ManagedProcessArgs describe a service's process (see managed_process.Options, which they're one and the same as)
+type ManagedProcessArgs = managed_process.Options
+
+// HTTPProbeArgs describe a probe that makes an HTTP request, succeeding if the response is as expected
+type HTTPProbeArgs struct {
+	URL     string
+	Method  string // GET if empty
+	Headers map[string]string
+	// MinStatus and MaxStatus (both inclusive) bound the expected status code; 200 - 399 if both are 0
+	MinStatus int
+	MaxStatus int
+	// BodyContains (if set) is a string the response body must contain
+	BodyContains string
+	// BodyMatches (if set) is a regex the response body must match
+	BodyMatches *regexp.Regexp
+	// Timeout bounds each attempt; the probe interval if 0
+	Timeout time.Duration
+}
+
+// SocketProbeArgs describe a probe that connects to a TCP or unix socket, succeeding if it can (and, if Expect is set,
+// if it receives what's expected)
+type SocketProbeArgs struct {
+	Network string // tcp or unix
+	Address string // host:port for tcp, a path for unix
+	// Send (if set) is sent once connected, e.g. to prompt a reply
+	Send string
+	// Expect (if set) is a string that must be received (e.g. a banner, or the reply to Send)
+	Expect string
+	// Timeout bounds each attempt (connecting and any sending and receiving); the probe interval if 0
+	Timeout time.Duration
+}
+
+// LogProbeArgs describe a probe that watches the service's own logs, becoming ready once a line matches Matches and (if
+// FailureMatches is set) not ready once a line matches that
+type LogProbeArgs struct {
+	Stream         string // stdout or stderr; both if empty
+	Matches        *regexp.Regexp
+	FailureMatches *regexp.Regexp
 }
 
 type StartupProbeArgs struct {
-	StartupTolerance time.Duration
+	StartupTolerance time.Duration // anything within this long of starting is ignored
+	InitialDelay     time.Duration // nothing is attempted until this long after starting
 	ProbeInterval    time.Duration
+	SuccessThreshold int  // successes in a row to be ready; 1 if 0
+	FailureThreshold int  // failures in a row (once the startup tolerance has passed) to give up; 1 if 0
+	RestartOnFailure bool // if set, the process is restarted on giving up (rather than being left to it)
 	Command          string
+	Argv             []string // if set, run directly (exec form) rather than as Command via /bin/bash
+	Attributes       process.Attributes
+	Timeout          time.Duration    // bounds each run of Command / Argv (a failure if it's exceeded); 0 means none
+	HTTP             *HTTPProbeArgs   // if set, probe over HTTP rather than by running Command / Argv
+	Socket           *SocketProbeArgs // if set, probe by connecting to a socket rather than by running Command / Argv
+	Log              *LogProbeArgs    // if set, probe by watching the service's logs rather than by running Command / Argv
 }
 
 type LivenessProbeArgs struct {
+	InitialDelay      time.Duration // nothing is attempted until this long after starting
 	ProbeInterval     time.Duration
-	PermittedFailures int
+	PermittedFailures int  // as for a FailureThreshold of PermittedFailures + 1 (if FailureThreshold isn't set)
+	SuccessThreshold  int  // successes in a row to be live; 1 if 0
+	FailureThreshold  int  // failures in a row to be dead; 1 if 0
+	RestartOnFailure  bool // if set, the process is restarted on being dead
 	Command           string
+	Argv              []string // if set, run directly (exec form) rather than as Command via /bin/bash
+	Attributes        process.Attributes
+	Timeout           time.Duration    // bounds each run of Command / Argv (a failure if it's exceeded); 0 means none
+	HTTP              *HTTPProbeArgs   // if set, probe over HTTP rather than by running Command / Argv
+	Socket            *SocketProbeArgs // if set, probe by connecting to a socket rather than by running Command / Argv
+	Log               *LogProbeArgs    // if set, probe by watching the service's logs rather than by running Command / Argv
+}
+
+// ReadinessProbeArgs describe a probe that gates the service's dependents (which aren't started until it's ready) but
+// which never restarts the service
+type ReadinessProbeArgs struct {
+	InitialDelay     time.Duration // nothing is attempted until this long after starting
+	ProbeInterval    time.Duration
+	SuccessThreshold int // successes in a row to be ready; 1 if 0
+	FailureThreshold int // failures in a row to be not ready; 1 if 0
+	Command          string
+	Argv             []string // if set, run directly (exec form) rather than as Command via /bin/bash
+	Attributes       process.Attributes
+	Timeout          time.Duration    // bounds each run of Command / Argv (a failure if it's exceeded); 0 means none
+	HTTP             *HTTPProbeArgs   // if set, probe over HTTP rather than by running Command / Argv
+	Socket           *SocketProbeArgs // if set, probe by connecting to a socket rather than by running Command / Argv
+	Log              *LogProbeArgs    // if set, probe by watching the service's logs rather than by running Command / Argv
 }
 
 type ServiceArgs struct {
@@ -33,6 +102,7 @@ type ServiceArgs struct {
 	ManagedProcessArgs ManagedProcessArgs
 	StartupProbeArgs   *StartupProbeArgs
 	LivenessProbeArgs  *LivenessProbeArgs
+	ReadinessProbeArgs *ReadinessProbeArgs
 }
 
 var (
@@ -0,0 +1,778 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPath          = "dspo.yaml"
+	defaultShell         = "/bin/bash"
+	defaultRestartWait   = time.Second * 1
+	defaultProbeInterval = time.Second * 1
+	maxSignal            = 64 // SIGRTMAX on Linux
+)
+
+// Duration is a time.Duration that unmarshals from a Go duration string (e.g. "1.5s") or from an integer number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var seconds int64
+	if value.Decode(&seconds) == nil {
+		if seconds < 0 {
+			return fmt.Errorf("line %v: duration must not be negative", value.Line)
+		}
+
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	var raw string
+	err := value.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("line %v: duration must be a string or an integer number of seconds", value.Line)
+	}
+
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("line %v: %v", value.Line, err)
+	}
+
+	if parsed < 0 {
+		return fmt.Errorf("line %v: duration must not be negative", value.Line)
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+var (
+	signalByName = map[string]syscall.Signal{
+		"HUP":  syscall.SIGHUP,
+		"INT":  syscall.SIGINT,
+		"QUIT": syscall.SIGQUIT,
+		"KILL": syscall.SIGKILL,
+		"USR1": syscall.SIGUSR1,
+		"USR2": syscall.SIGUSR2,
+		"TERM": syscall.SIGTERM,
+	}
+)
+
+// Signal is a syscall.Signal that unmarshals from a signal name (e.g. "SIGTERM" or "TERM") or from a signal number
+type Signal syscall.Signal
+
+func (s *Signal) UnmarshalYAML(value *yaml.Node) error {
+	var raw string
+	err := value.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("line %v: signal must be a name or a number", value.Line)
+	}
+
+	number, err := strconv.Atoi(raw)
+	if err == nil {
+		if number <= 0 || number > maxSignal {
+			return fmt.Errorf("line %v: signal number must be between 1 and %v, not %v", value.Line, maxSignal, number)
+		}
+
+		*s = Signal(number)
+		return nil
+	}
+
+	signal, ok := signalByName[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(raw)), "SIG")]
+	if !ok {
+		return fmt.Errorf("line %v: unknown signal %#+v", value.Line, raw)
+	}
+
+	*s = Signal(signal)
+
+	return nil
+}
+
+// Command accepts either a string, run with the shell (shell form), or a list, run directly as an argv (exec form, as
+// for a Dockerfile CMD)
+type Command struct {
+	Shell string
+	Argv  []string
+}
+
+func (c *Command) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Decode(&c.Shell)
+	case yaml.SequenceNode:
+		return value.Decode(&c.Argv)
+	}
+
+	return fmt.Errorf("line %v: command must be a string or a list", value.Line)
+}
+
+func (c *Command) empty() bool {
+	if len(c.Argv) > 0 {
+		return strings.TrimSpace(c.Argv[0]) == ""
+	}
+
+	return strings.TrimSpace(c.Shell) == ""
+}
+
+// Umask is an os.FileMode that unmarshals from an octal string or number (e.g. "022" or 0022)
+type Umask os.FileMode
+
+func (u *Umask) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %v: umask must be an octal number", value.Line)
+	}
+
+	raw := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(value.Value), "0o"), "0O")
+
+	parsed, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || parsed > 0o777 {
+		return fmt.Errorf("line %v: umask must be an octal number between 000 and 777, not %#+v", value.Line, value.Value)
+	}
+
+	*u = Umask(parsed)
+
+	return nil
+}
+
+// Environment accepts either the compose list form (["KEY=value"]) or the map form ({KEY: value})
+type Environment []string
+
+func (e *Environment) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var raw []string
+		err := value.Decode(&raw)
+		if err != nil {
+			return err
+		}
+
+		*e = raw
+	case yaml.MappingNode:
+		env := make([]string, 0)
+
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			env = append(env, fmt.Sprintf("%v=%v", value.Content[i].Value, value.Content[i+1].Value))
+		}
+
+		*e = env
+	default:
+		return fmt.Errorf("line %v: environment must be a list or a map", value.Line)
+	}
+
+	return nil
+}
+
+// DependsOn accepts either the compose list form ([a, b]) or the map form ({a: {...}, b: {...}}); only the names are used
+type DependsOn []string
+
+func (d *DependsOn) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var raw []string
+		err := value.Decode(&raw)
+		if err != nil {
+			return err
+		}
+
+		*d = raw
+	case yaml.MappingNode:
+		names := make([]string, 0)
+
+		for i := 0; i < len(value.Content); i += 2 {
+			names = append(names, value.Content[i].Value)
+		}
+
+		*d = names
+	default:
+		return fmt.Errorf("line %v: depends_on must be a list or a map", value.Line)
+	}
+
+	return nil
+}
+
+// RestartBackoff grows the wait between restarts, starting from restart_wait
+type RestartBackoff struct {
+	Multiplier  float64  `yaml:"multiplier"`
+	Max         Duration `yaml:"max"`
+	Jitter      float64  `yaml:"jitter"`
+	ResetWindow Duration `yaml:"reset_window"`
+}
+
+// CrashLoop sets how many exits (exits) within how long (window) mean a service is crash looping
+type CrashLoop struct {
+	Exits  int      `yaml:"exits"`
+	Window Duration `yaml:"window"`
+}
+
+// StatusRange is an inclusive range of HTTP status codes that unmarshals from a single code (e.g. 200) or a range (e.g.
+// "200-299")
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (r *StatusRange) UnmarshalYAML(value *yaml.Node) error {
+	var raw string
+	err := value.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("line %v: status must be a code or a range of codes", value.Line)
+	}
+
+	rawMin, rawMax, isRange := strings.Cut(raw, "-")
+	if !isRange {
+		rawMax = rawMin
+	}
+
+	r.Min, err = strconv.Atoi(strings.TrimSpace(rawMin))
+	if err == nil {
+		r.Max, err = strconv.Atoi(strings.TrimSpace(rawMax))
+	}
+
+	if err != nil || r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+		return fmt.Errorf("line %v: status must be a code or a range of codes (e.g. 200-299), not %#+v", value.Line, raw)
+	}
+
+	return nil
+}
+
+// HTTPProbe probes with an HTTP request rather than a command
+type HTTPProbe struct {
+	URL          string            `yaml:"url"`
+	Method       string            `yaml:"method"`
+	Headers      map[string]string `yaml:"headers"`
+	Status       *StatusRange      `yaml:"status"`
+	BodyContains string            `yaml:"body_contains"`
+	BodyMatches  string            `yaml:"body_matches"`
+	Timeout      Duration          `yaml:"timeout"`
+}
+
+// SocketProbe probes by connecting to a socket rather than with a command; address (host:port) is for tcp and path is
+// for unix
+type SocketProbe struct {
+	Address string   `yaml:"address"`
+	Path    string   `yaml:"path"`
+	Send    string   `yaml:"send"`
+	Expect  string   `yaml:"expect"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+// LogProbe probes by watching the service's own logs rather than with a command; stream (stdout or stderr) limits it to
+// one of them
+type LogProbe struct {
+	Matches        string `yaml:"matches"`
+	FailureMatches string `yaml:"failure_matches"`
+	Stream         string `yaml:"stream"`
+}
+
+// ProbeAction is how a probe probes; exactly one of command, http, tcp, unix or log must be set, with timeout (for a
+// command) bounding each run of the command
+type ProbeAction struct {
+	Command Command      `yaml:"command"`
+	Timeout Duration     `yaml:"timeout"`
+	HTTP    *HTTPProbe   `yaml:"http"`
+	TCP     *SocketProbe `yaml:"tcp"`
+	Unix    *SocketProbe `yaml:"unix"`
+	Log     *LogProbe    `yaml:"log"`
+}
+
+type StartupProbe struct {
+	ProbeAction      `yaml:",inline"`
+	StartupTolerance Duration `yaml:"startup_tolerance"`
+	InitialDelay     Duration `yaml:"initial_delay"`
+	Interval         Duration `yaml:"interval"`
+	SuccessThreshold int      `yaml:"success_threshold"`
+	FailureThreshold int      `yaml:"failure_threshold"`
+	RestartOnFailure bool     `yaml:"restart_on_failure"`
+}
+
+// LivenessProbe has permitted_failures for compatibility; it's the same as a failure_threshold of one more
+type LivenessProbe struct {
+	ProbeAction       `yaml:",inline"`
+	InitialDelay      Duration `yaml:"initial_delay"`
+	Interval          Duration `yaml:"interval"`
+	PermittedFailures int      `yaml:"permitted_failures"`
+	SuccessThreshold  int      `yaml:"success_threshold"`
+	FailureThreshold  int      `yaml:"failure_threshold"`
+	RestartOnFailure  bool     `yaml:"restart_on_failure"`
+}
+
+// ReadinessProbe gates the service's dependents, but never restarts the service
+type ReadinessProbe struct {
+	ProbeAction      `yaml:",inline"`
+	InitialDelay     Duration `yaml:"initial_delay"`
+	Interval         Duration `yaml:"interval"`
+	SuccessThreshold int      `yaml:"success_threshold"`
+	FailureThreshold int      `yaml:"failure_threshold"`
+}
+
+type Service struct {
+	Command         Command         `yaml:"command"`
+	Shell           string          `yaml:"shell"`
+	Environment     Environment     `yaml:"environment"`
+	InheritEnv      *bool           `yaml:"inherit_env"`
+	Restart         string          `yaml:"restart"`
+	RestartWait     *Duration       `yaml:"restart_wait"`
+	RestartBackoff  *RestartBackoff `yaml:"restart_backoff"`
+	MaxRestarts     int             `yaml:"max_restarts"`
+	CrashLoop       *CrashLoop      `yaml:"crash_loop"`
+	StopSignal      Signal          `yaml:"stop_signal"`
+	StopGracePeriod Duration        `yaml:"stop_grace_period"`
+	WorkingDir      string          `yaml:"working_dir"`
+	User            string          `yaml:"user"`
+	Group           string          `yaml:"group"`
+	Umask           *Umask          `yaml:"umask"`
+	DependsOn       DependsOn       `yaml:"depends_on"`
+	StartupProbe    *StartupProbe   `yaml:"startup_probe"`
+	LivenessProbe   *LivenessProbe  `yaml:"liveness_probe"`
+	ReadinessProbe  *ReadinessProbe `yaml:"readiness_probe"`
+}
+
+type Config struct {
+	Name     string             `yaml:"name"`
+	Services map[string]Service `yaml:"services"`
+	dir      string             // relative working dirs are relative to this (if set by Load)
+}
+
+func Parse(b []byte) (*Config, error) {
+	c := Config{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Services) == 0 {
+		return nil, fmt.Errorf("no services defined")
+	}
+
+	return &c, nil
+}
+
+// Load parses the given file; if no project name is set, the name of the directory holding the file is used, and
+// relative working dirs are taken as relative to that directory
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.dir = filepath.Dir(absPath)
+
+	if c.Name == "" {
+		c.Name = filepath.Base(c.dir)
+	}
+
+	return c, nil
+}
+
+func durationOrDefault(d Duration, defaultDuration time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDuration
+	}
+
+	return time.Duration(d)
+}
+
+// checkThresholds returns an error if either of the given thresholds is negative
+func checkThresholds(successThreshold int, failureThreshold int) error {
+	if successThreshold < 0 {
+		return fmt.Errorf("success_threshold must not be negative")
+	}
+
+	if failureThreshold < 0 {
+		return fmt.Errorf("failure_threshold must not be negative")
+	}
+
+	return nil
+}
+
+// getArgs checks that there's exactly one way of probing, mapping it (unless it's a command) onto what's expected by
+// probe.NewHTTP, probe.NewSocket or probe.NewLog; a relative unix socket path is relative to the given working dir (if
+// any)
+func (a *ProbeAction) getArgs(
+	workingDir string,
+) (*common.HTTPProbeArgs, *common.SocketProbeArgs, *common.LogProbeArgs, error) {
+	actions := 0
+	for _, isSet := range []bool{!a.Command.empty(), a.HTTP != nil, a.TCP != nil, a.Unix != nil, a.Log != nil} {
+		if isSet {
+			actions++
+		}
+	}
+
+	if actions != 1 {
+		return nil, nil, nil, fmt.Errorf("must have one of command, http, tcp, unix or log")
+	}
+
+	if a.Timeout != 0 && a.Command.empty() {
+		return nil, nil, nil, fmt.Errorf("timeout is for a command (http, tcp and unix have a timeout of their own)")
+	}
+
+	if a.HTTP != nil {
+		httpArgs, err := getHTTP(a.HTTP)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return httpArgs, nil, nil, nil
+	}
+
+	if a.Log != nil {
+		logArgs, err := getLog(a.Log)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return nil, nil, logArgs, nil
+	}
+
+	if a.TCP != nil {
+		if a.TCP.Path != "" {
+			return nil, nil, nil, fmt.Errorf("tcp takes an address rather than a path")
+		}
+
+		_, _, err := net.SplitHostPort(a.TCP.Address)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("tcp address must be host:port, not %#+v", a.TCP.Address)
+		}
+
+		return nil, getSocket("tcp", a.TCP.Address, a.TCP), nil, nil
+	}
+
+	if a.Unix != nil {
+		if a.Unix.Address != "" {
+			return nil, nil, nil, fmt.Errorf("unix takes a path rather than an address")
+		}
+
+		if a.Unix.Path == "" {
+			return nil, nil, nil, fmt.Errorf("unix has no path")
+		}
+
+		path := a.Unix.Path
+		if !filepath.IsAbs(path) && workingDir != "" {
+			path = filepath.Join(workingDir, path)
+		}
+
+		return nil, getSocket("unix", path, a.Unix), nil, nil
+	}
+
+	return nil, nil, nil, nil
+}
+
+// getLog maps the given log probe onto what's expected by probe.NewLog
+func getLog(l *LogProbe) (*common.LogProbeArgs, error) {
+	if l.Matches == "" {
+		return nil, fmt.Errorf("log has no matches")
+	}
+
+	if l.Stream != "" && l.Stream != "stdout" && l.Stream != "stderr" {
+		return nil, fmt.Errorf("log stream must be stdout or stderr, not %#+v", l.Stream)
+	}
+
+	logArgs := common.LogProbeArgs{
+		Stream: l.Stream,
+	}
+
+	var err error
+
+	logArgs.Matches, err = regexp.Compile(l.Matches)
+	if err != nil {
+		return nil, fmt.Errorf("log matches: %v", err)
+	}
+
+	if l.FailureMatches != "" {
+		logArgs.FailureMatches, err = regexp.Compile(l.FailureMatches)
+		if err != nil {
+			return nil, fmt.Errorf("log failure_matches: %v", err)
+		}
+	}
+
+	return &logArgs, nil
+}
+
+func getSocket(network string, address string, s *SocketProbe) *common.SocketProbeArgs {
+	return &common.SocketProbeArgs{
+		Network: network,
+		Address: address,
+		Send:    s.Send,
+		Expect:  s.Expect,
+		Timeout: time.Duration(s.Timeout),
+	}
+}
+
+// getHTTP maps the given HTTP probe onto what's expected by probe.NewHTTP
+func getHTTP(h *HTTPProbe) (*common.HTTPProbeArgs, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("http url must be an absolute http or https url, not %#+v", h.URL)
+	}
+
+	httpArgs := common.HTTPProbeArgs{
+		URL:          h.URL,
+		Method:       strings.ToUpper(h.Method),
+		Headers:      h.Headers,
+		BodyContains: h.BodyContains,
+		Timeout:      time.Duration(h.Timeout),
+	}
+
+	if h.Status != nil {
+		httpArgs.MinStatus = h.Status.Min
+		httpArgs.MaxStatus = h.Status.Max
+	}
+
+	if h.BodyMatches != "" {
+		httpArgs.BodyMatches, err = regexp.Compile(h.BodyMatches)
+		if err != nil {
+			return nil, fmt.Errorf("http body_matches: %v", err)
+		}
+	}
+
+	return &httpArgs, nil
+}
+
+// ServiceArgs maps the config onto the arguments expected by system.New, sorted by service name
+func (c *Config) ServiceArgs() ([]common.ServiceArgs, error) {
+	names := make([]string, 0)
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	allServiceArgs := make([]common.ServiceArgs, 0)
+
+	for _, name := range names {
+		service := c.Services[name]
+
+		if service.Command.empty() {
+			return nil, fmt.Errorf("service %#+v has no command", name)
+		}
+
+		if service.MaxRestarts < 0 {
+			return nil, fmt.Errorf("service %#+v max_restarts must not be negative", name)
+		}
+
+		restartPolicy, maxRestarts, err := managed_process.ParseRestartPolicy(service.Restart)
+		if err != nil {
+			return nil, fmt.Errorf("service %#+v: %v", name, err)
+		}
+
+		if maxRestarts > 0 && service.MaxRestarts > 0 && maxRestarts != service.MaxRestarts {
+			return nil, fmt.Errorf(
+				"service %#+v: restart %#+v conflicts with max_restarts %v",
+				name,
+				service.Restart,
+				service.MaxRestarts,
+			)
+		}
+
+		if service.MaxRestarts > 0 {
+			maxRestarts = service.MaxRestarts
+		}
+
+		shell := service.Shell
+		if shell == "" {
+			shell = defaultShell
+		}
+
+		inheritEnv := true
+		if service.InheritEnv != nil {
+			inheritEnv = *service.InheritEnv
+		}
+
+		restartWaitDuration := defaultRestartWait
+		if service.RestartWait != nil {
+			restartWaitDuration = time.Duration(*service.RestartWait)
+		}
+
+		backoff := managed_process.Backoff{}
+		if service.RestartBackoff != nil {
+			if service.RestartBackoff.Multiplier < 0 {
+				return nil, fmt.Errorf("service %#+v restart_backoff multiplier must not be negative", name)
+			}
+
+			if service.RestartBackoff.Jitter < 0 || service.RestartBackoff.Jitter > 1 {
+				return nil, fmt.Errorf("service %#+v restart_backoff jitter must be between 0 and 1", name)
+			}
+
+			backoff = managed_process.Backoff{
+				Multiplier:  service.RestartBackoff.Multiplier,
+				Max:         time.Duration(service.RestartBackoff.Max),
+				Jitter:      service.RestartBackoff.Jitter,
+				ResetWindow: time.Duration(service.RestartBackoff.ResetWindow),
+			}
+		}
+
+		crashLoop := managed_process.CrashLoop{}
+		if service.CrashLoop != nil {
+			if service.CrashLoop.Exits < 0 {
+				return nil, fmt.Errorf("service %#+v crash_loop exits must not be negative", name)
+			}
+
+			crashLoop = managed_process.CrashLoop{
+				Exits:  service.CrashLoop.Exits,
+				Window: time.Duration(service.CrashLoop.Window),
+			}
+		}
+
+		// the probes run in the same context as the service itself
+		attributes := process.Attributes{
+			WorkingDir: service.WorkingDir,
+			User:       service.User,
+			Group:      service.Group,
+		}
+
+		if attributes.WorkingDir != "" && !filepath.IsAbs(attributes.WorkingDir) && c.dir != "" {
+			attributes.WorkingDir = filepath.Join(c.dir, attributes.WorkingDir)
+		}
+
+		if service.Umask != nil {
+			umask := os.FileMode(*service.Umask)
+			attributes.Umask = &umask
+		}
+
+		serviceArgs := common.ServiceArgs{
+			Name:      name,
+			DependsOn: service.DependsOn,
+			ManagedProcessArgs: common.ManagedProcessArgs{
+				RestartPolicy:       restartPolicy,
+				Shell:               shell,
+				Command:             service.Command.Shell,
+				Argv:                service.Command.Argv,
+				Env:                 service.Environment,
+				InheritEnv:          inheritEnv,
+				Attributes:          attributes,
+				RestartWaitDuration: restartWaitDuration,
+				Backoff:             backoff,
+				MaxRestarts:         maxRestarts,
+				CrashLoop:           crashLoop,
+				StopSignal:          syscall.Signal(service.StopSignal),
+				StopGracePeriod:     time.Duration(service.StopGracePeriod),
+			},
+		}
+
+		if service.StartupProbe != nil {
+			httpArgs, socketArgs, logArgs, err := service.StartupProbe.getArgs(attributes.WorkingDir)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v startup_probe %v", name, err)
+			}
+
+			err = checkThresholds(service.StartupProbe.SuccessThreshold, service.StartupProbe.FailureThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v startup_probe %v", name, err)
+			}
+
+			serviceArgs.StartupProbeArgs = &common.StartupProbeArgs{
+				StartupTolerance: time.Duration(service.StartupProbe.StartupTolerance),
+				InitialDelay:     time.Duration(service.StartupProbe.InitialDelay),
+				ProbeInterval:    durationOrDefault(service.StartupProbe.Interval, defaultProbeInterval),
+				SuccessThreshold: service.StartupProbe.SuccessThreshold,
+				FailureThreshold: service.StartupProbe.FailureThreshold,
+				RestartOnFailure: service.StartupProbe.RestartOnFailure,
+				Command:          service.StartupProbe.Command.Shell,
+				Argv:             service.StartupProbe.Command.Argv,
+				Attributes:       attributes,
+				Timeout:          time.Duration(service.StartupProbe.Timeout),
+				HTTP:             httpArgs,
+				Socket:           socketArgs,
+				Log:              logArgs,
+			}
+		}
+
+		if service.LivenessProbe != nil {
+			httpArgs, socketArgs, logArgs, err := service.LivenessProbe.getArgs(attributes.WorkingDir)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v liveness_probe %v", name, err)
+			}
+
+			err = checkThresholds(service.LivenessProbe.SuccessThreshold, service.LivenessProbe.FailureThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v liveness_probe %v", name, err)
+			}
+
+			if service.LivenessProbe.PermittedFailures < 0 {
+				return nil, fmt.Errorf("service %#+v liveness_probe permitted_failures must not be negative", name)
+			}
+
+			if service.LivenessProbe.PermittedFailures != 0 && service.LivenessProbe.FailureThreshold != 0 {
+				return nil, fmt.Errorf(
+					"service %#+v liveness_probe must have only one of permitted_failures or failure_threshold",
+					name,
+				)
+			}
+
+			serviceArgs.LivenessProbeArgs = &common.LivenessProbeArgs{
+				InitialDelay:      time.Duration(service.LivenessProbe.InitialDelay),
+				ProbeInterval:     durationOrDefault(service.LivenessProbe.Interval, defaultProbeInterval),
+				PermittedFailures: service.LivenessProbe.PermittedFailures,
+				SuccessThreshold:  service.LivenessProbe.SuccessThreshold,
+				FailureThreshold:  service.LivenessProbe.FailureThreshold,
+				RestartOnFailure:  service.LivenessProbe.RestartOnFailure,
+				Command:           service.LivenessProbe.Command.Shell,
+				Argv:              service.LivenessProbe.Command.Argv,
+				Attributes:        attributes,
+				Timeout:           time.Duration(service.LivenessProbe.Timeout),
+				HTTP:              httpArgs,
+				Socket:            socketArgs,
+				Log:               logArgs,
+			}
+		}
+
+		if service.ReadinessProbe != nil {
+			httpArgs, socketArgs, logArgs, err := service.ReadinessProbe.getArgs(attributes.WorkingDir)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v readiness_probe %v", name, err)
+			}
+
+			err = checkThresholds(service.ReadinessProbe.SuccessThreshold, service.ReadinessProbe.FailureThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("service %#+v readiness_probe %v", name, err)
+			}
+
+			serviceArgs.ReadinessProbeArgs = &common.ReadinessProbeArgs{
+				InitialDelay:     time.Duration(service.ReadinessProbe.InitialDelay),
+				ProbeInterval:    durationOrDefault(service.ReadinessProbe.Interval, defaultProbeInterval),
+				SuccessThreshold: service.ReadinessProbe.SuccessThreshold,
+				FailureThreshold: service.ReadinessProbe.FailureThreshold,
+				Command:          service.ReadinessProbe.Command.Shell,
+				Argv:             service.ReadinessProbe.Command.Argv,
+				Attributes:       attributes,
+				Timeout:          time.Duration(service.ReadinessProbe.Timeout),
+				HTTP:             httpArgs,
+				Socket:           socketArgs,
+				Log:              logArgs,
+			}
+		}
+
+		allServiceArgs = append(allServiceArgs, serviceArgs)
+	}
+
+	return allServiceArgs, nil
+}
@@ -0,0 +1,588 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	happyPathConfig = `
+services:
+  db:
+    command: "while true; do echo 'db'; sleep 1; done"
+    restart: unless-stopped
+    environment:
+      PGPORT: 5432
+    startup_probe:
+      command: "pg_isready"
+      startup_tolerance: 5s
+      interval: 500ms
+    liveness_probe:
+      command: ["pg_isready", "-q"]
+      timeout: 2s
+      permitted_failures: 3
+  api:
+    command: ["./api", "--port", "8080"]
+    shell: /bin/sh
+    inherit_env: false
+    environment:
+      - "DB_PORT=5432"
+    restart: on-failure
+    restart_wait: 2
+    restart_backoff:
+      multiplier: 2
+      max: 1m
+      jitter: 0.1
+      reset_window: 30s
+    max_restarts: 5
+    crash_loop:
+      exits: 5
+      window: 2m
+    stop_signal: SIGINT
+    stop_grace_period: 30s
+    working_dir: ./api
+    umask: "027"
+    depends_on:
+      - db
+`
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("HappyPath", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, DefaultPath)
+		require.NoError(t, os.WriteFile(path, []byte(happyPathConfig), 0o644))
+
+		c, err := Load(path)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Base(dir), c.Name)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+
+		umask := os.FileMode(0o027)
+
+		require.Equal(
+			t,
+			[]common.ServiceArgs{
+				{
+					Name:      "api",
+					DependsOn: []string{"db"},
+					ManagedProcessArgs: common.ManagedProcessArgs{
+						RestartPolicy: managed_process.OnFailure,
+						Shell:         "/bin/sh",
+						Argv:          []string{"./api", "--port", "8080"},
+						Env:           []string{"DB_PORT=5432"},
+						InheritEnv:    false,
+						Attributes: process.Attributes{
+							WorkingDir: filepath.Join(dir, "api"),
+							Umask:      &umask,
+						},
+						RestartWaitDuration: time.Second * 2,
+						Backoff: managed_process.Backoff{
+							Multiplier:  2,
+							Max:         time.Minute,
+							Jitter:      0.1,
+							ResetWindow: time.Second * 30,
+						},
+						MaxRestarts: 5,
+						CrashLoop: managed_process.CrashLoop{
+							Exits:  5,
+							Window: time.Minute * 2,
+						},
+						StopSignal:      syscall.SIGINT,
+						StopGracePeriod: time.Second * 30,
+					},
+				},
+				{
+					Name: "db",
+					ManagedProcessArgs: common.ManagedProcessArgs{
+						RestartPolicy:       managed_process.UnlessStopped,
+						Shell:               "/bin/bash",
+						Command:             "while true; do echo 'db'; sleep 1; done",
+						Env:                 []string{"PGPORT=5432"},
+						InheritEnv:          true,
+						RestartWaitDuration: time.Second * 1,
+					},
+					StartupProbeArgs: &common.StartupProbeArgs{
+						StartupTolerance: time.Second * 5,
+						ProbeInterval:    time.Millisecond * 500,
+						Command:          "pg_isready",
+					},
+					LivenessProbeArgs: &common.LivenessProbeArgs{
+						ProbeInterval:     time.Second * 1,
+						PermittedFailures: 3,
+						Argv:              []string{"pg_isready", "-q"},
+						Timeout:           time.Second * 2,
+					},
+				},
+			},
+			serviceArgs,
+		)
+	})
+
+	t.Run("DependsOnMapForm", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+  b:
+    command: "true"
+    depends_on:
+      a:
+        condition: service_started
+`))
+		require.NoError(t, err)
+		require.Equal(t, DependsOn{"a"}, c.Services["b"].DependsOn)
+	})
+
+	t.Run("UnknownRestartPolicy", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    restart: sometimes
+`))
+		require.NoError(t, err)
+
+		_, err = c.ServiceArgs()
+		require.Error(t, err)
+	})
+
+	t.Run("MissingCommand", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    restart: "no"
+`))
+		require.NoError(t, err)
+
+		_, err = c.ServiceArgs()
+		require.Error(t, err)
+	})
+
+	t.Run("EmptyArgv", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: []
+`))
+		require.NoError(t, err)
+
+		_, err = c.ServiceArgs()
+		require.Error(t, err)
+	})
+
+	t.Run("BadUmask", func(t *testing.T) {
+		_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    umask: "0999"
+`))
+		require.Error(t, err)
+	})
+
+	t.Run("OnFailureMaxRestarts", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    restart: on-failure:3
+  b:
+    command: "true"
+    restart: on-failure:3
+    max_restarts: 4
+`))
+		require.NoError(t, err)
+
+		_, err = c.ServiceArgs()
+		require.Error(t, err)
+
+		delete(c.Services, "b")
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Equal(t, managed_process.OnFailure, serviceArgs[0].ManagedProcessArgs.RestartPolicy)
+		require.Equal(t, 3, serviceArgs[0].ManagedProcessArgs.MaxRestarts)
+	})
+
+	t.Run("BadJitter", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    restart_backoff:
+      jitter: 2
+`))
+		require.NoError(t, err)
+
+		_, err = c.ServiceArgs()
+		require.Error(t, err)
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    comand: "typo"
+`))
+		require.Error(t, err)
+	})
+
+	t.Run("BadDuration", func(t *testing.T) {
+		_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    restart_wait: soon
+`))
+		require.Error(t, err)
+	})
+
+	t.Run("NegativeDuration", func(t *testing.T) {
+		for _, serviceConfig := range []string{
+			"startup_probe:\n      interval: -1s\n      log:\n        matches: ok",
+			"liveness_probe:\n      interval: -1\n      command: \"true\"",
+			"readiness_probe:\n      interval: -500ms\n      tcp:\n        address: localhost:8080",
+			"restart_wait: -2s",
+		} {
+			_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    ` + serviceConfig + `
+`))
+			require.Error(t, err, serviceConfig)
+		}
+
+		require.Equal(t, time.Second, durationOrDefault(Duration(-time.Second), time.Second))
+	})
+
+	t.Run("StopSignalForms", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    stop_signal: TERM
+  b:
+    command: "true"
+    stop_signal: 3
+`))
+		require.NoError(t, err)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Equal(t, syscall.SIGTERM, serviceArgs[0].ManagedProcessArgs.StopSignal)
+		require.Equal(t, syscall.SIGQUIT, serviceArgs[1].ManagedProcessArgs.StopSignal)
+	})
+
+	t.Run("UnknownStopSignal", func(t *testing.T) {
+		_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    stop_signal: SIGNOPE
+`))
+		require.Error(t, err)
+
+		for _, stopSignal := range []string{"0", "-15", "99"} {
+			_, err = Parse([]byte(`
+services:
+  a:
+    command: "true"
+    stop_signal: ` + stopSignal + `
+`))
+			require.Error(t, err, stopSignal)
+		}
+	})
+
+	t.Run("HTTPProbe", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      http:
+        url: http://localhost:8080/healthz
+        status: 200
+        body_matches: "^ok"
+    liveness_probe:
+      http:
+        url: https://localhost:8443/healthz
+        method: head
+        headers:
+          Authorization: Bearer abc
+        status: 200-299
+        body_contains: ok
+        timeout: 250ms
+      permitted_failures: 2
+`))
+		require.NoError(t, err)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Len(t, serviceArgs, 1)
+
+		require.Equal(
+			t,
+			&common.StartupProbeArgs{
+				ProbeInterval: time.Second * 1,
+				HTTP: &common.HTTPProbeArgs{
+					URL:         "http://localhost:8080/healthz",
+					MinStatus:   200,
+					MaxStatus:   200,
+					BodyMatches: regexp.MustCompile("^ok"),
+				},
+			},
+			serviceArgs[0].StartupProbeArgs,
+		)
+
+		require.Equal(
+			t,
+			&common.LivenessProbeArgs{
+				ProbeInterval:     time.Second * 1,
+				PermittedFailures: 2,
+				HTTP: &common.HTTPProbeArgs{
+					URL:          "https://localhost:8443/healthz",
+					Method:       "HEAD",
+					Headers:      map[string]string{"Authorization": "Bearer abc"},
+					MinStatus:    200,
+					MaxStatus:    299,
+					BodyContains: "ok",
+					Timeout:      time.Millisecond * 250,
+				},
+			},
+			serviceArgs[0].LivenessProbeArgs,
+		)
+	})
+
+	t.Run("BadHTTPProbe", func(t *testing.T) {
+		for _, probeConfig := range []string{
+			"command: \"true\"\n      http:\n        url: http://localhost/",
+			"http:\n        url: localhost:8080",
+			"http:\n        url: http://localhost/\n        body_matches: \"(\"",
+		} {
+			c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      ` + probeConfig + `
+`))
+			require.NoError(t, err)
+
+			_, err = c.ServiceArgs()
+			require.Error(t, err, probeConfig)
+		}
+
+		_, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      http:
+        url: http://localhost/
+        status: 299-200
+`))
+		require.Error(t, err)
+	})
+
+	t.Run("SocketProbes", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    working_dir: /srv/a
+    startup_probe:
+      tcp:
+        address: localhost:6379
+        send: "PING\r\n"
+        expect: "+PONG"
+        timeout: 250ms
+    liveness_probe:
+      unix:
+        path: ./a.sock
+`))
+		require.NoError(t, err)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Len(t, serviceArgs, 1)
+
+		require.Equal(
+			t,
+			&common.SocketProbeArgs{
+				Network: "tcp",
+				Address: "localhost:6379",
+				Send:    "PING\r\n",
+				Expect:  "+PONG",
+				Timeout: time.Millisecond * 250,
+			},
+			serviceArgs[0].StartupProbeArgs.Socket,
+		)
+
+		require.Equal(
+			t,
+			&common.SocketProbeArgs{
+				Network: "unix",
+				Address: "/srv/a/a.sock",
+			},
+			serviceArgs[0].LivenessProbeArgs.Socket,
+		)
+
+		for _, probeConfig := range []string{
+			"tcp:\n        address: localhost",
+			"tcp:\n        path: ./a.sock",
+			"unix:\n        address: localhost:6379",
+			"unix:\n        expect: hello",
+			"tcp:\n        address: localhost:6379\n      unix:\n        path: ./a.sock",
+			"tcp:\n        address: localhost:6379\n      timeout: 1s",
+		} {
+			c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    liveness_probe:
+      ` + probeConfig + `
+`))
+			require.NoError(t, err)
+
+			_, err = c.ServiceArgs()
+			require.Error(t, err, probeConfig)
+		}
+	})
+
+	t.Run("LogProbe", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      log:
+        matches: "Listening on"
+        failure_matches: "^FATAL"
+        stream: stderr
+`))
+		require.NoError(t, err)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Len(t, serviceArgs, 1)
+
+		require.Equal(
+			t,
+			&common.LogProbeArgs{
+				Stream:         "stderr",
+				Matches:        regexp.MustCompile("Listening on"),
+				FailureMatches: regexp.MustCompile("^FATAL"),
+			},
+			serviceArgs[0].StartupProbeArgs.Log,
+		)
+
+		for _, probeConfig := range []string{
+			"log:\n        failure_matches: oops",
+			"log:\n        matches: \"(\"",
+			"log:\n        matches: ok\n        stream: stdin",
+			"log:\n        matches: ok\n      command: \"true\"",
+		} {
+			c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      ` + probeConfig + `
+`))
+			require.NoError(t, err)
+
+			_, err = c.ServiceArgs()
+			require.Error(t, err, probeConfig)
+		}
+	})
+
+	t.Run("ThresholdsAndReadinessProbe", func(t *testing.T) {
+		c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    startup_probe:
+      command: "true"
+      initial_delay: 1s
+      success_threshold: 2
+      failure_threshold: 5
+      restart_on_failure: true
+    liveness_probe:
+      tcp:
+        address: "127.0.0.1:8080"
+      interval: 2s
+      failure_threshold: 3
+      restart_on_failure: true
+    readiness_probe:
+      http:
+        url: "http://127.0.0.1:8080/ready"
+      initial_delay: 500ms
+      success_threshold: 3
+`))
+		require.NoError(t, err)
+
+		serviceArgs, err := c.ServiceArgs()
+		require.NoError(t, err)
+		require.Len(t, serviceArgs, 1)
+
+		startupProbeArgs := serviceArgs[0].StartupProbeArgs
+		require.NotNil(t, startupProbeArgs)
+		require.Equal(t, time.Second*1, startupProbeArgs.InitialDelay)
+		require.Equal(t, 2, startupProbeArgs.SuccessThreshold)
+		require.Equal(t, 5, startupProbeArgs.FailureThreshold)
+		require.True(t, startupProbeArgs.RestartOnFailure)
+
+		livenessProbeArgs := serviceArgs[0].LivenessProbeArgs
+		require.NotNil(t, livenessProbeArgs)
+		require.Equal(t, time.Second*2, livenessProbeArgs.ProbeInterval)
+		require.Equal(t, 3, livenessProbeArgs.FailureThreshold)
+		require.True(t, livenessProbeArgs.RestartOnFailure)
+
+		readinessProbeArgs := serviceArgs[0].ReadinessProbeArgs
+		require.NotNil(t, readinessProbeArgs)
+		require.Equal(t, time.Millisecond*500, readinessProbeArgs.InitialDelay)
+		require.Equal(t, defaultProbeInterval, readinessProbeArgs.ProbeInterval)
+		require.Equal(t, 3, readinessProbeArgs.SuccessThreshold)
+		require.Equal(t, "http://127.0.0.1:8080/ready", readinessProbeArgs.HTTP.URL)
+
+		for _, probeConfig := range []string{
+			"liveness_probe:\n      command: \"true\"\n      permitted_failures: 2\n      failure_threshold: 3",
+			"liveness_probe:\n      command: \"true\"\n      permitted_failures: -1",
+			"startup_probe:\n      command: \"true\"\n      success_threshold: -1",
+			"readiness_probe:\n      command: \"true\"\n      failure_threshold: -1",
+			"readiness_probe:\n      command: \"true\"\n      restart_on_failure: true",
+		} {
+			c, err := Parse([]byte(`
+services:
+  a:
+    command: "true"
+    ` + probeConfig + `
+`))
+			// a readiness probe has no restart_on_failure, so that one doesn't get as far as ServiceArgs
+			if err == nil {
+				_, err = c.ServiceArgs()
+			}
+
+			require.Error(t, err, probeConfig)
+		}
+	})
+
+	t.Run("NoServices", func(t *testing.T) {
+		_, err := Parse([]byte(`name: empty`))
+		require.Error(t, err)
+	})
+}
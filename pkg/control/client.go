@@ -0,0 +1,176 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/system"
+)
+
+const (
+	dialTimeout = time.Second * 5
+	depth       = 1024
+	// log lines can be long, so allow for far more than bufio's default
+	maxResponseSize = 16 * 1024 * 1024
+)
+
+// Client drives a Server over its socket; every call uses its own connection, so a Client is safe for concurrent use
+type Client struct {
+	socketPath string
+}
+
+func NewClient(socketPath string) *Client {
+	c := Client{
+		socketPath: socketPath,
+	}
+
+	return &c
+}
+
+func (c *Client) request(request Request) (net.Conn, *bufio.Scanner, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request.Version = ProtocolVersion
+
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxResponseSize)
+
+	return conn, scanner, nil
+}
+
+func readResponse(scanner *bufio.Scanner) (*Response, error) {
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("connection closed by server")
+		}
+
+		return nil, err
+	}
+
+	response := Response{}
+
+	err := json.Unmarshal(scanner.Bytes(), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	if response.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %v (want %v)", response.Version, ProtocolVersion)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("%v", response.Error)
+	}
+
+	return &response, nil
+}
+
+func (c *Client) do(request Request) (*Response, error) {
+	conn, scanner, err := c.request(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return readResponse(scanner)
+}
+
+func (c *Client) Services() ([]ServiceStatus, error) {
+	response, err := c.do(Request{Method: MethodServices})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Services, nil
+}
+
+func (c *Client) Start(names ...string) error {
+	_, err := c.do(Request{Method: MethodStart, Services: names})
+
+	return err
+}
+
+func (c *Client) Stop(names ...string) error {
+	_, err := c.do(Request{Method: MethodStop, Services: names})
+
+	return err
+}
+
+// Down stops all services and shuts down the server's host; a timeout of 0 means the system default
+func (c *Client) Down(timeout time.Duration) (*system.StopReport, error) {
+	response, err := c.do(Request{Method: MethodDown, Timeout: timeout.Milliseconds()})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.StopReport, nil
+}
+
+// Logs streams the logs for the given services (or all services if none are given); the returned channel is closed
+// when the stream ends, either because the history has been sent (when not following), because the server went away or
+// because the returned func was called
+func (c *Client) Logs(options LogsOptions, names ...string) (chan managed_process.Log, func(), error) {
+	conn, scanner, err := c.request(Request{Method: MethodLogs, Services: names, LogsOptions: options})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// errors (e.g. an unknown service) come back instead of the acknowledgement
+	_, err = readResponse(scanner)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	logs := make(chan managed_process.Log, depth)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(logs)
+
+		for {
+			response, err := readResponse(scanner)
+			if err != nil {
+				return
+			}
+
+			if response.Log == nil {
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case logs <- *response.Log:
+			}
+		}
+	}()
+
+	once := new(sync.Once)
+
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			_ = conn.Close()
+		})
+	}
+
+	return logs, cancel, nil
+}
@@ -0,0 +1,250 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/system"
+	"github.com/stretchr/testify/require"
+)
+
+func getServiceArgs(name string) common.ServiceArgs {
+	return common.ServiceArgs{
+		Name: name,
+		ManagedProcessArgs: common.ManagedProcessArgs{
+			RestartPolicy:       managed_process.UnlessStopped,
+			Shell:               "/bin/bash",
+			Command:             "while true; do echo 'tick'; sleep 0.1; done",
+			InheritEnv:          true,
+			RestartWaitDuration: time.Millisecond * 50,
+		},
+	}
+}
+
+func TestNew(t *testing.T) {
+	s := system.New(
+		[]common.ServiceArgs{
+			getServiceArgs("service_a"),
+			getServiceArgs("service_b"),
+		},
+		"test",
+	)
+	require.NoError(t, s.Start())
+	defer func() {
+		_ = s.Stop()
+	}()
+
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+
+	down := make(chan struct{})
+	onDown := new(sync.Once)
+
+	server := NewServer(socketPath, s, "", func() { onDown.Do(func() { close(down) }) }, "test_control")
+	require.NoError(t, server.Start())
+	defer func() {
+		_ = server.Stop()
+	}()
+
+	client := NewClient(socketPath)
+
+	t.Run("Services", func(t *testing.T) {
+		serviceStatuses, err := client.Services()
+		require.NoError(t, err)
+
+		for i := range serviceStatuses {
+			require.Len(t, serviceStatuses[i].History, 1)
+			require.False(t, serviceStatuses[i].History[0].Ended())
+			serviceStatuses[i].History = nil
+		}
+
+		require.Equal(
+			t,
+			[]ServiceStatus{
+				{Name: "service_a", Started: true, StartupReady: true, LivenessReady: true, ReadinessReady: true, Running: true},
+				{Name: "service_b", Started: true, StartupReady: true, LivenessReady: true, ReadinessReady: true, Running: true},
+			},
+			serviceStatuses,
+		)
+	})
+
+	t.Run("StopAndStart", func(t *testing.T) {
+		require.NoError(t, client.Stop("service_a"))
+
+		serviceStatuses, err := client.Services()
+		require.NoError(t, err)
+		require.False(t, serviceStatuses[0].Started)
+		require.True(t, serviceStatuses[1].Started)
+
+		require.Error(t, client.Stop("service_a"))
+		require.Error(t, client.Stop("not_a_service"))
+
+		require.NoError(t, client.Start("service_a"))
+
+		serviceStatuses, err = client.Services()
+		require.NoError(t, err)
+		require.True(t, serviceStatuses[0].Started)
+	})
+
+	t.Run("Logs", func(t *testing.T) {
+		logs, cancel, err := client.Logs(LogsOptions{Follow: true, Tail: -1}, "service_b")
+		require.NoError(t, err)
+		defer cancel()
+
+		for i := 0; i < 3; i++ {
+			select {
+			case l := <-logs:
+				require.Equal(t, "service_b", l.Name)
+				require.Equal(t, "tick\n", string(l.Data))
+			case <-time.After(time.Second * 1):
+				require.Fail(t, "timed out waiting for logs")
+			}
+		}
+
+		_, _, err = client.Logs(LogsOptions{}, "not_a_service")
+		require.Error(t, err)
+
+		// a follower that can't afford to lose anything
+		logs, cancel, err = client.Logs(LogsOptions{Follow: true, Tail: -1, Policy: fanout.Block}, "service_b")
+		require.NoError(t, err)
+		defer cancel()
+
+		select {
+		case l := <-logs:
+			require.Equal(t, "tick\n", string(l.Data))
+		case <-time.After(time.Second * 1):
+			require.Fail(t, "timed out waiting for logs")
+		}
+
+		_, _, err = client.Logs(LogsOptions{Follow: true, Policy: "drop-everything"}, "service_b")
+		require.Error(t, err)
+	})
+
+	t.Run("LogsHistory", func(t *testing.T) {
+		require.Eventually(
+			t,
+			func() bool {
+				logs, cancel, err := client.Logs(LogsOptions{}, "service_a")
+				require.NoError(t, err)
+				defer cancel()
+
+				count := 0
+				for range logs {
+					count++
+				}
+
+				return count >= 3
+			},
+			time.Second*2,
+			time.Millisecond*100,
+		)
+
+		logs, cancel, err := client.Logs(LogsOptions{Tail: 2}, "service_a", "service_b")
+		require.NoError(t, err)
+		defer cancel()
+
+		countByName := make(map[string]int)
+		lastTimestamp := int64(0)
+		for l := range logs {
+			countByName[l.Name]++
+			require.GreaterOrEqual(t, l.Timestamp, lastTimestamp)
+			lastTimestamp = l.Timestamp
+		}
+		require.Equal(t, map[string]int{"service_a": 2, "service_b": 2}, countByName)
+
+		logs, cancel, err = client.Logs(LogsOptions{Until: 1}, "service_a")
+		require.NoError(t, err)
+		defer cancel()
+
+		_, ok := <-logs
+		require.False(t, ok)
+
+		logs, cancel, err = client.Logs(LogsOptions{Since: time.Now().Add(time.Hour).UnixMilli()}, "service_a")
+		require.NoError(t, err)
+		defer cancel()
+
+		_, ok = <-logs
+		require.False(t, ok)
+	})
+
+	t.Run("MergeStoredLogs", func(t *testing.T) {
+		storedLogs := []managed_process.Log{
+			{Name: "service_a", Timestamp: 1, Seq: 1},
+			{Name: "service_a", Timestamp: 2, Seq: 2},
+			{Name: "service_b", Timestamp: 2, Seq: 1},
+		}
+
+		logs := []managed_process.Log{
+			{Name: "service_a", Timestamp: 2, Seq: 2},
+			{Name: "service_a", Timestamp: 3, Seq: 3},
+			{Name: "service_b", Timestamp: 4, Seq: 2},
+		}
+
+		require.Equal(
+			t,
+			[]managed_process.Log{
+				{Name: "service_a", Timestamp: 1, Seq: 1},
+				{Name: "service_a", Timestamp: 2, Seq: 2},
+				{Name: "service_b", Timestamp: 2, Seq: 1},
+				{Name: "service_a", Timestamp: 3, Seq: 3},
+				{Name: "service_b", Timestamp: 4, Seq: 2},
+			},
+			merge(storedLogs, logs, 0),
+		)
+
+		require.Equal(
+			t,
+			[]managed_process.Log{
+				{Name: "service_a", Timestamp: 3, Seq: 3},
+				{Name: "service_b", Timestamp: 4, Seq: 2},
+			},
+			merge(storedLogs, logs, 1),
+		)
+	})
+
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		conn, err := net.Dial("unix", socketPath)
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		require.NoError(t, json.NewEncoder(conn).Encode(Request{Version: ProtocolVersion + 1, Method: MethodServices}))
+
+		scanner := bufio.NewScanner(conn)
+		require.True(t, scanner.Scan())
+
+		response := Response{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &response))
+		require.Contains(t, response.Error, "unsupported protocol version")
+	})
+
+	t.Run("Down", func(t *testing.T) {
+		stopReport, err := client.Down(time.Second * 5)
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			&system.StopReport{
+				Tiers:       [][]string{{"service_a", "service_b"}},
+				ForceKilled: []string{},
+			},
+			stopReport,
+		)
+
+		select {
+		case <-down:
+		case <-time.After(time.Second * 1):
+			require.Fail(t, "timed out waiting for onDown")
+		}
+
+		_, err = client.Down(0)
+		require.Error(t, err)
+	})
+}
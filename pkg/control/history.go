@@ -0,0 +1,74 @@
+package control
+
+import (
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/logstore"
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+func matches(l managed_process.Log, wantedByName map[string]bool, options LogsOptions) bool {
+	if len(wantedByName) > 0 && !wantedByName[l.Name] {
+		return false
+	}
+
+	if options.Since != 0 && l.Timestamp < options.Since {
+		return false
+	}
+
+	if options.Until != 0 && l.Timestamp > options.Until {
+		return false
+	}
+
+	return true
+}
+
+// getReplay returns what to ask of the system's replay buffer for the given options; the tail is left to be applied
+// once Until has been, so everything since Since is asked for
+func getReplay(options LogsOptions) fanout.Replay {
+	if options.Tail < 0 {
+		return fanout.Replay{}
+	}
+
+	return fanout.Replay{Last: -1, Since: options.Since}
+}
+
+type logKey struct {
+	name      string
+	timestamp int64
+	seq       uint64
+}
+
+// merge combines logs read from the log store with those from the replay buffer (either of which may hold logs the
+// other doesn't), dropping duplicates and applying the tail (as per LogsOptions) per service
+func merge(storedLogs []managed_process.Log, logs []managed_process.Log, tail int) []managed_process.Log {
+	seen := make(map[logKey]bool)
+	mergedByName := make(map[string][]managed_process.Log)
+
+	for _, someLogs := range [][]managed_process.Log{storedLogs, logs} {
+		for _, l := range someLogs {
+			key := logKey{name: l.Name, timestamp: l.Timestamp, seq: l.Seq}
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			mergedByName[l.Name] = append(mergedByName[l.Name], l)
+		}
+	}
+
+	merged := make([]managed_process.Log, 0)
+
+	for _, serviceLogs := range mergedByName {
+		logstore.Sort(serviceLogs)
+
+		if tail > 0 && len(serviceLogs) > tail {
+			serviceLogs = serviceLogs[len(serviceLogs)-tail:]
+		}
+
+		merged = append(merged, serviceLogs...)
+	}
+
+	logstore.Sort(merged)
+
+	return merged
+}
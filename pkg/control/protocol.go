@@ -0,0 +1,77 @@
+package control
+
+import (
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/service"
+	"github.com/initialed85/dspo/pkg/system"
+)
+
+// ProtocolVersion is sent with every request and response; a server rejects requests that don't match
+const ProtocolVersion = 1
+
+type Method string
+
+const (
+	// MethodServices returns a single response listing every service and its state
+	MethodServices Method = "services"
+	// MethodStart starts the named services, returning a single empty response
+	MethodStart Method = "start"
+	// MethodStop stops the named services, returning a single empty response
+	MethodStop Method = "stop"
+	// MethodLogs returns an empty response once subscribed, then a response per log message from history followed (if
+	// following) by a response per live log message until the client hangs up
+	MethodLogs Method = "logs"
+	// MethodDown stops all services (in reverse dependency order) and then shuts down the server's host, returning a
+	// single response with the stop report
+	MethodDown Method = "down"
+)
+
+type LogsOptions struct {
+	// Follow keeps the stream open for live logs once the history has been sent
+	Follow bool `json:"follow,omitempty"`
+	// Tail limits the history to the last Tail messages per service; 0 means all of it and negative means none of it
+	Tail int `json:"tail,omitempty"`
+	// Since and Until (both inclusive and in unix milliseconds, as per managed_process.Log) bound the messages sent; 0
+	// means unbounded
+	Since int64 `json:"since,omitempty"`
+	Until int64 `json:"until,omitempty"`
+	// Policy is what happens to live logs when following and the client isn't keeping up (e.g. block, so that nothing
+	// is lost, at the cost of holding up the services); empty means the default (drop-newest)
+	Policy fanout.Policy `json:"policy,omitempty"`
+}
+
+// Request is written by the client as a single line of JSON
+type Request struct {
+	Version  int      `json:"version"`
+	Method   Method   `json:"method"`
+	Services []string `json:"services,omitempty"`
+	// Timeout (in milliseconds) bounds the time taken by MethodDown; 0 means the system default
+	Timeout int64 `json:"timeout,omitempty"`
+	LogsOptions
+}
+
+type ServiceStatus struct {
+	Name           string `json:"name"`
+	Started        bool   `json:"started"`
+	StartupReady   bool   `json:"startup_ready"`
+	LivenessReady  bool   `json:"liveness_ready"`
+	ReadinessReady bool   `json:"readiness_ready"`
+	Running        bool   `json:"running"`
+	CrashLooping   bool   `json:"crash_looping"`
+	Failed         bool   `json:"failed"`
+	Restarts       int    `json:"restarts"`
+	// History holds the most recent runs of the service's process, oldest first
+	History []managed_process.Run `json:"history"`
+	// ProbeHistory holds the most recent results of each of the service's probes, oldest first
+	ProbeHistory service.ProbeHistory `json:"probe_history"`
+}
+
+// Response is written by the server as one or more lines of JSON; a non-empty Error ends the exchange
+type Response struct {
+	Version    int                  `json:"version"`
+	Error      string               `json:"error,omitempty"`
+	Services   []ServiceStatus      `json:"services,omitempty"`
+	Log        *managed_process.Log `json:"log,omitempty"`
+	StopReport *system.StopReport   `json:"stop_report,omitempty"`
+}
@@ -0,0 +1,386 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/initialed85/dspo/internal"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/logstore"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/system"
+)
+
+type Server struct {
+	socketPath string
+	system     *system.System
+	logDir     string
+	onDown     func()
+	listener   net.Listener
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     *slog.Logger
+}
+
+// NewServer returns a server for the given system; logs older than those the system keeps for replay are read from the
+// log store in the given dir (if any)
+func NewServer(
+	socketPath string,
+	system *system.System,
+	logDir string,
+	onDown func(),
+	name string,
+) *Server {
+	s := Server{
+		socketPath: socketPath,
+		system:     system,
+		logDir:     logDir,
+		onDown:     onDown,
+		logger:     internal.GetLogger(name),
+	}
+
+	return &s
+}
+
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return fmt.Errorf("already started")
+	}
+
+	// a socket left behind by a supervisor that didn't get to clean up; the caller is expected to hold the project lock
+	err := os.Remove(s.socketPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(s.socketPath, 0o600)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	s.listener = listener
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(1)
+	go s.runAccept(s.ctx, listener)
+
+	s.logger.Debug("started", "socket_path", s.socketPath)
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.mu.Lock()
+
+	if s.listener == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("not started")
+	}
+
+	s.cancel()
+	_ = s.listener.Close()
+	s.listener = nil
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	_ = os.Remove(s.socketPath)
+
+	s.logger.Debug("stopped")
+
+	return nil
+}
+
+func (s *Server) runAccept(ctx context.Context, listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("failed to accept", "error", err)
+			}
+
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// unblock any streaming response if we're stopped
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+
+	respond := func(response Response) error {
+		response.Version = ProtocolVersion
+		return encoder.Encode(response)
+	}
+
+	respondWithError := func(err error) {
+		_ = respond(Response{Error: err.Error()})
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+
+	request := Request{}
+
+	err = json.Unmarshal(line, &request)
+	if err != nil {
+		respondWithError(fmt.Errorf("failed to parse request: %v", err))
+		return
+	}
+
+	if request.Version != ProtocolVersion {
+		respondWithError(fmt.Errorf("unsupported protocol version %v (want %v)", request.Version, ProtocolVersion))
+		return
+	}
+
+	switch request.Method {
+	case MethodServices:
+		_ = respond(Response{Services: s.getServiceStatuses()})
+	case MethodStart, MethodStop:
+		err = s.startOrStop(request)
+		if err != nil {
+			respondWithError(err)
+			return
+		}
+
+		_ = respond(Response{})
+	case MethodLogs:
+		// the client has nothing more to say, so a read returning means it has hung up
+		go func() {
+			_, _ = reader.ReadByte()
+			cancel()
+		}()
+
+		err = s.streamLogs(ctx, request, respond)
+		if err != nil {
+			respondWithError(err)
+			return
+		}
+	case MethodDown:
+		timeout := system.DefaultStopTimeout
+		if request.Timeout > 0 {
+			timeout = time.Millisecond * time.Duration(request.Timeout)
+		}
+
+		stopReport, err := s.system.StopWithTimeout(timeout)
+
+		// whatever happened, our host should go away now
+		if s.onDown != nil {
+			defer s.onDown()
+		}
+
+		if err != nil {
+			respondWithError(err)
+			return
+		}
+
+		_ = respond(Response{StopReport: stopReport})
+	default:
+		respondWithError(fmt.Errorf("unknown method %#+v", request.Method))
+	}
+}
+
+func (s *Server) getServiceStatuses() []ServiceStatus {
+	serviceStatuses := make([]ServiceStatus, 0)
+
+	for _, actualService := range s.system.ServiceByName() {
+		serviceStatuses = append(
+			serviceStatuses,
+			ServiceStatus{
+				Name:           actualService.Name(),
+				Started:        actualService.Started(),
+				StartupReady:   actualService.StartupReady(),
+				LivenessReady:  actualService.LivenessReady(),
+				ReadinessReady: actualService.ReadinessReady(),
+				Running:        actualService.Running(),
+				CrashLooping:   actualService.CrashLooping(),
+				Failed:         actualService.Failed(),
+				Restarts:       actualService.Restarts(),
+				History:        actualService.History(),
+				ProbeHistory:   actualService.ProbeHistory(),
+			},
+		)
+	}
+
+	sort.Slice(serviceStatuses, func(i, j int) bool {
+		return serviceStatuses[i].Name < serviceStatuses[j].Name
+	})
+
+	return serviceStatuses
+}
+
+func (s *Server) startOrStop(request Request) error {
+	if len(request.Services) == 0 {
+		return fmt.Errorf("no services given to %v", request.Method)
+	}
+
+	serviceByName := s.system.ServiceByName()
+
+	for _, name := range request.Services {
+		_, ok := serviceByName[name]
+		if !ok {
+			return fmt.Errorf("unknown service %#+v", name)
+		}
+	}
+
+	for _, name := range request.Services {
+		var err error
+
+		if request.Method == MethodStart {
+			err = s.system.StartService(name)
+		} else {
+			err = s.system.StopService(name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) streamLogs(ctx context.Context, request Request, respond func(Response) error) error {
+	wantedByName := make(map[string]bool)
+	serviceByName := s.system.ServiceByName()
+
+	for _, name := range request.Services {
+		_, ok := serviceByName[name]
+		if !ok {
+			return fmt.Errorf("unknown service %#+v", name)
+		}
+
+		wantedByName[name] = true
+	}
+
+	var logs []managed_process.Log
+	var follower chan managed_process.Log
+	unfollow := func() {}
+
+	policy, err := fanout.ParsePolicy(string(request.Policy))
+	if err != nil {
+		return err
+	}
+
+	replay := getReplay(request.LogsOptions)
+
+	if request.Follow {
+		logs, follower, unfollow, err = s.system.SubscribeToLogsWithReplay(policy, replay)
+		if err != nil {
+			return err
+		}
+	} else {
+		logs = s.system.ReplayLogs(replay)
+	}
+	defer unfollow()
+
+	matchingLogs := make([]managed_process.Log, 0)
+	for _, l := range logs {
+		if matches(l, wantedByName, request.LogsOptions) {
+			matchingLogs = append(matchingLogs, l)
+		}
+	}
+
+	var storedLogs []managed_process.Log
+
+	if s.logDir != "" && request.Tail >= 0 {
+		names := make([]string, 0)
+		for name := range wantedByName {
+			names = append(names, name)
+		}
+
+		storedLogs, err = logstore.Read(
+			s.logDir,
+			names,
+			logstore.Query{Since: request.Since, Until: request.Until, Tail: request.Tail},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to read log store: %v", err)
+		}
+	}
+
+	// the store may be a little behind the replay buffer (which only goes back so far), so the two are merged
+	logs = merge(storedLogs, matchingLogs, request.Tail)
+
+	err = respond(Response{})
+	if err != nil {
+		return nil
+	}
+
+	for _, l := range logs {
+		l := l
+
+		err = respond(Response{Log: &l})
+		if err != nil {
+			return nil
+		}
+	}
+
+	if follower == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case l := <-follower:
+			if request.Until != 0 && l.Timestamp > request.Until {
+				return nil
+			}
+
+			if !matches(l, wantedByName, request.LogsOptions) {
+				continue
+			}
+
+			err = respond(Response{Log: &l})
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -5,95 +5,103 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
-	"github.com/initialed85/dspo/pkg/managed_process"
 )
 
-type Fanin struct {
-	messages                chan managed_process.Log
-	consumerByConsumerID    map[uuid.UUID]chan managed_process.Log
-	unsubscribeByConsumerID map[uuid.UUID]func()
-	mu                      sync.Mutex
-	ctx                     context.Context
-	cancel                  context.CancelFunc
+// forwarder moves messages from a single consumer to the fanin's channel, so that each consumer keeps its own ordering
+// and nothing is done while there's nothing to do
+type forwarder struct {
+	cancel      context.CancelFunc
+	done        chan struct{}
+	unsubscribe func()
 }
 
-func New(consumer chan managed_process.Log) *Fanin {
-	f := Fanin{
-		messages:                consumer,
-		consumerByConsumerID:    make(map[uuid.UUID]chan managed_process.Log),
-		unsubscribeByConsumerID: make(map[uuid.UUID]func()),
+type Fanin[T any] struct {
+	messages              chan T
+	forwarderByConsumerID map[uuid.UUID]*forwarder
+	mu                    sync.Mutex
+	ctx                   context.Context
+	cancel                context.CancelFunc
+}
+
+func New[T any](consumer chan T) *Fanin[T] {
+	f := Fanin[T]{
+		messages:              consumer,
+		forwarderByConsumerID: make(map[uuid.UUID]*forwarder),
 	}
 
 	f.ctx, f.cancel = context.WithCancel(context.Background())
 
-	go f.runConsume()
-
 	return &f
-
 }
 
-func (f *Fanin) runConsume() {
-	for {
+func (f *Fanin[T]) runForward(ctx context.Context, consumer chan T, done chan struct{}) {
+	defer close(done)
 
+	for {
 		select {
-		case <-f.ctx.Done():
+		case <-ctx.Done():
 			return
-		default:
-		}
-
-		f.mu.Lock()
-		consumerByConsumerID := f.consumerByConsumerID
-		f.mu.Unlock()
+		case message, ok := <-consumer:
+			if !ok {
+				return
+			}
 
-		for _, consumer := range consumerByConsumerID {
 			select {
-			case message := <-consumer:
-				f.messages <- message
-			default:
+			case <-ctx.Done():
+				return
+			case f.messages <- message:
 			}
 		}
 	}
 }
 
-func (f *Fanin) Close() {
-	f.cancel()
-
+// Close stops consuming from (and unsubscribes from) every consumer; the fanin can be used again afterwards
+func (f *Fanin[T]) Close() {
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	f.cancel()
+	forwarderByConsumerID := f.forwarderByConsumerID
+	f.forwarderByConsumerID = make(map[uuid.UUID]*forwarder)
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.mu.Unlock()
 
-	for _, unsubscribe := range f.unsubscribeByConsumerID {
-		unsubscribe()
+	for _, forwarder := range forwarderByConsumerID {
+		<-forwarder.done
+		forwarder.unsubscribe()
 	}
-
-	f.consumerByConsumerID = make(map[uuid.UUID]chan managed_process.Log)
-	f.unsubscribeByConsumerID = make(map[uuid.UUID]func())
-
-	f.ctx, f.cancel = context.WithCancel(context.Background())
 }
 
-func (f *Fanin) Consume(consumer chan managed_process.Log, unsubscribe func()) func() {
+// Consume forwards everything from the given consumer until the returned func is called (or the fanin is closed), at
+// which point the given unsubscribe func is called; nothing is forwarded from the consumer once the returned func has
+// returned
+func (f *Fanin[T]) Consume(consumer chan T, unsubscribe func()) func() {
 	consumerID := uuid.New()
 
-	wrappedUnsubscribe := func() {
+	f.mu.Lock()
+	ctx, cancel := context.WithCancel(f.ctx)
+	forwarder := &forwarder{
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		unsubscribe: unsubscribe,
+	}
+	f.forwarderByConsumerID[consumerID] = forwarder
+	f.mu.Unlock()
+
+	go f.runForward(ctx, consumer, forwarder.done)
+
+	return func() {
 		f.mu.Lock()
-		_, ok := f.consumerByConsumerID[consumerID]
+		_, ok := f.forwarderByConsumerID[consumerID]
 		if !ok {
 			f.mu.Unlock()
 			return
 		}
 
-		f.mu.Lock()
-		delete(f.consumerByConsumerID, consumerID)
-		delete(f.unsubscribeByConsumerID, consumerID)
+		delete(f.forwarderByConsumerID, consumerID)
 		f.mu.Unlock()
 
+		forwarder.cancel()
+		<-forwarder.done
+
 		unsubscribe()
 	}
-
-	f.mu.Lock()
-	f.consumerByConsumerID[consumerID] = consumer
-	f.unsubscribeByConsumerID[consumerID] = wrappedUnsubscribe
-	f.mu.Unlock()
-
-	return wrappedUnsubscribe
 }
@@ -3,12 +3,14 @@ package fanin
 import (
 	"fmt"
 	"math/rand"
+	"syscall"
 	"testing"
 	"time"
 
 	_fanout "github.com/initialed85/dspo/pkg/fanout"
 	"github.com/initialed85/dspo/pkg/managed_process"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNew(t *testing.T) {
@@ -21,6 +23,7 @@ func TestNew(t *testing.T) {
 
 		consumer := make(chan managed_process.Log, 1024)
 		f := New(consumer)
+		defer f.Close()
 
 		consumer1, cancel1 := fanout.Subscribe()
 		f.Consume(consumer1, cancel1)
@@ -54,6 +57,7 @@ func TestNew(t *testing.T) {
 
 		consumer := make(chan managed_process.Log, 1024)
 		f := New(consumer)
+		defer f.Close()
 
 		consumer1, cancel1 := fanout.Subscribe()
 		f.Consume(consumer1, cancel1)
@@ -89,6 +93,7 @@ func TestNew(t *testing.T) {
 
 		consumer := make(chan managed_process.Log, 1024)
 		f := New(consumer)
+		defer f.Close()
 
 		consumer1, cancel1 := fanout.Subscribe()
 		f.Consume(consumer1, cancel1)
@@ -116,4 +121,169 @@ func TestNew(t *testing.T) {
 			assert.Equal(t, message, <-consumer)
 		}
 	})
+
+	t.Run("PerSourceOrdering", func(t *testing.T) {
+		consumer := make(chan managed_process.Log, 1024)
+		f := New(consumer)
+		defer f.Close()
+
+		sources := make([]chan managed_process.Log, 0)
+		for i := 0; i < 10; i++ {
+			source := make(chan managed_process.Log)
+			f.Consume(source, func() {})
+			sources = append(sources, source)
+		}
+
+		for i, source := range sources {
+			go func(i int, source chan managed_process.Log) {
+				for seq := uint64(1); seq <= 1000; seq++ {
+					source <- managed_process.Log{Name: fmt.Sprintf("source_%v", i), Seq: seq}
+				}
+			}(i, source)
+		}
+
+		lastSeqByName := make(map[string]uint64)
+		for i := 0; i < 10*1000; i++ {
+			select {
+			case l := <-consumer:
+				require.Equal(t, lastSeqByName[l.Name]+1, l.Seq, l.Name)
+				lastSeqByName[l.Name] = l.Seq
+			case <-time.After(time.Second * 1):
+				require.FailNow(t, "timed out waiting for messages")
+			}
+		}
+	})
+
+	t.Run("ConsumeAndUnsubscribe", func(t *testing.T) {
+		consumer := make(chan managed_process.Log, 1024)
+		f := New(consumer)
+		defer f.Close()
+
+		unsubscribes := 0
+		source := make(chan managed_process.Log, 1)
+		unsubscribe := f.Consume(source, func() { unsubscribes++ })
+
+		source <- managed_process.Log{Seq: 1}
+		assert.Equal(t, uint64(1), (<-consumer).Seq)
+
+		unsubscribe()
+		unsubscribe()
+		assert.Equal(t, 1, unsubscribes)
+
+		// nothing is forwarded once unsubscribed
+		source <- managed_process.Log{Seq: 2}
+		select {
+		case <-consumer:
+			require.FailNow(t, "unexpectedly forwarded a message after unsubscribing")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		// a closed consumer is no problem either
+		closedSource := make(chan managed_process.Log)
+		close(closedSource)
+		f.Consume(closedSource, func() {})
+
+		otherSource := make(chan managed_process.Log)
+		f.Consume(otherSource, func() { unsubscribes++ })
+
+		f.Close()
+		assert.Equal(t, 2, unsubscribes)
+
+		// and the fanin can be used again after closing
+		f.Consume(otherSource, func() {})
+		otherSource <- managed_process.Log{Seq: 3}
+		assert.Equal(t, uint64(3), (<-consumer).Seq)
+	})
+
+	t.Run("OtherMessageTypes", func(t *testing.T) {
+		consumer := make(chan string, 1024)
+		f := New(consumer)
+		defer f.Close()
+
+		source1 := make(chan string)
+		f.Consume(source1, func() {})
+
+		source2 := make(chan string)
+		f.Consume(source2, func() {})
+
+		source1 <- "hello"
+		assert.Equal(t, "hello", <-consumer)
+
+		source2 <- "world"
+		assert.Equal(t, "world", <-consumer)
+	})
+
+	t.Run("IdleCPU", func(t *testing.T) {
+		consumer := make(chan managed_process.Log, 1024)
+		f := New(consumer)
+		defer f.Close()
+
+		for i := 0; i < 100; i++ {
+			f.Consume(make(chan managed_process.Log), func() {})
+		}
+
+		// generous, but a busy loop would use all of it
+		assert.Less(t, getCPUFraction(time.Millisecond*500), 0.1)
+	})
+}
+
+// getCPUFraction returns the CPU time used by this process over the given period as a fraction of that period
+func getCPUFraction(period time.Duration) float64 {
+	getCPUTime := func() time.Duration {
+		rusage := syscall.Rusage{}
+		_ = syscall.Getrusage(syscall.RUSAGE_SELF, &rusage)
+
+		return time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+	}
+
+	before := getCPUTime()
+	time.Sleep(period)
+
+	return float64(getCPUTime()-before) / float64(period)
+}
+
+func BenchmarkFanin(b *testing.B) {
+	consumer := make(chan managed_process.Log, 1024)
+	f := New(consumer)
+	defer f.Close()
+
+	sources := make([]chan managed_process.Log, 0)
+	for i := 0; i < 10; i++ {
+		source := make(chan managed_process.Log, 1024)
+		f.Consume(source, func() {})
+		sources = append(sources, source)
+	}
+
+	message := managed_process.Log{Data: []byte("some data")}
+
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			sources[i%len(sources)] <- message
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		<-consumer
+	}
+}
+
+func BenchmarkFaninIdle(b *testing.B) {
+	consumer := make(chan managed_process.Log, 1024)
+	f := New(consumer)
+	defer f.Close()
+
+	for i := 0; i < 100; i++ {
+		f.Consume(make(chan managed_process.Log), func() {})
+	}
+
+	b.ResetTimer()
+
+	cpuFraction := float64(0)
+	for i := 0; i < b.N; i++ {
+		cpuFraction += getCPUFraction(time.Millisecond * 10)
+	}
+
+	b.ReportMetric(cpuFraction/float64(b.N), "cpu/wall")
 }
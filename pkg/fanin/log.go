@@ -0,0 +1,8 @@
+package fanin
+
+import (
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+// LogFanin is a Fanin for the logs of managed processes
+type LogFanin = Fanin[managed_process.Log]
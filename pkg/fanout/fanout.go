@@ -2,81 +2,351 @@ package fanout
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
-	"github.com/initialed85/dspo/pkg/managed_process"
 )
 
 const (
 	depth = 1024
 )
 
-type Fanout struct {
-	messages             chan managed_process.Log
-	consumerByConsumerID map[uuid.UUID]chan managed_process.Log
+// Policy describes what to do with a message for a consumer that isn't keeping up (i.e. whose buffer is full)
+type Policy string
+
+const (
+	// DropNewest drops the message (the default)
+	DropNewest Policy = "drop-newest"
+	// DropOldest drops the oldest buffered message to make room for the message
+	DropOldest Policy = "drop-oldest"
+	// Block waits for the consumer to make room, holding up every other consumer (and the producer) in the meantime
+	Block Policy = "block"
+	// SpillToDisk writes messages to a temp file until the consumer has caught up, so nothing is dropped and nobody
+	// else is held up
+	SpillToDisk Policy = "spill-to-disk"
+)
+
+// ParsePolicy parses the given policy, with an empty string meaning the default
+func ParsePolicy(raw string) (Policy, error) {
+	switch Policy(raw) {
+	case "":
+		return DropNewest, nil
+	case DropNewest, DropOldest, Block, SpillToDisk:
+		return Policy(raw), nil
+	}
+
+	return "", fmt.Errorf("unknown policy %#+v; must be one of drop-newest, drop-oldest, block or spill-to-disk", raw)
+}
+
+// Replay describes which of the recent messages (if the fanout keeps any) to hand out on subscribing; the zero value
+// means none of them
+type Replay struct {
+	// Last is the number of messages per source (e.g. per service) to hand out, with a negative number meaning all of
+	// them
+	Last int
+	// Since (in unix milliseconds) excludes anything older; 0 means unbounded
+	Since int64
+}
+
+// entry is a message kept for replay, along with its place in the order the messages were published
+type entry[T any] struct {
+	index   uint64
+	message T
+}
+
+type consumer[T any] struct {
+	messages chan T
+	policy   Policy
+	spill    *spill[T]
+	done     chan struct{}
+	doneOnce sync.Once
+	dropped  atomic.Uint64
+}
+
+func (c *consumer[T]) close() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+
+		if c.spill != nil {
+			c.spill.close()
+		}
+	})
+}
+
+type Fanout[T any] struct {
+	messages             chan T
+	consumerByConsumerID map[uuid.UUID]*consumer[T]
+	replayDepth          int
+	getSource            func(T) string
+	getTimestamp         func(T) int64
+	entriesBySource      map[string][]entry[T]
+	index                uint64
+	dropped              atomic.Uint64
 	mu                   sync.Mutex
 	ctx                  context.Context
 	cancel               context.CancelFunc
 }
 
-func New(messages chan managed_process.Log) *Fanout {
-	f := Fanout{
+func New[T any](messages chan T) *Fanout[T] {
+	return NewWithReplay(messages, 0, nil, nil)
+}
+
+// NewWithReplay returns a fanout that keeps the last replayDepth messages for each source (as given by getSource), for
+// subscribers that want to catch up on what they missed; getTimestamp gives the time (in unix milliseconds) of a message
+// for Replay.Since
+func NewWithReplay[T any](
+	messages chan T,
+	replayDepth int,
+	getSource func(T) string,
+	getTimestamp func(T) int64,
+) *Fanout[T] {
+	if getSource == nil {
+		getSource = func(T) string { return "" }
+	}
+
+	if getTimestamp == nil {
+		getTimestamp = func(T) int64 { return 0 }
+	}
+
+	f := Fanout[T]{
 		messages:             messages,
-		consumerByConsumerID: make(map[uuid.UUID]chan managed_process.Log),
+		consumerByConsumerID: make(map[uuid.UUID]*consumer[T]),
+		replayDepth:          replayDepth,
+		getSource:            getSource,
+		getTimestamp:         getTimestamp,
+		entriesBySource:      make(map[string][]entry[T]),
 	}
 
 	f.ctx, f.cancel = context.WithCancel(context.Background())
 
-	go f.runPublish()
+	go f.runPublish(f.ctx)
 
 	return &f
 }
 
-func (f *Fanout) runPublish() {
+func (f *Fanout[T]) runPublish(ctx context.Context) {
 	for {
 		select {
-		case <-f.ctx.Done():
+		case <-ctx.Done():
 			return
 		case message := <-f.messages:
+			// kept for replay under the same lock as the consumers are taken, so that a new subscriber gets each message
+			// either as a replay or live, never both and never neither
 			f.mu.Lock()
-			consumerByConsumerID := f.consumerByConsumerID
+			f.keep(message)
+			consumers := make([]*consumer[T], 0, len(f.consumerByConsumerID))
+			for _, c := range f.consumerByConsumerID {
+				consumers = append(consumers, c)
+			}
 			f.mu.Unlock()
 
-			for _, consumer := range consumerByConsumerID {
-				select {
-				case consumer <- message:
-				default:
-				}
+			for _, c := range consumers {
+				f.publish(ctx, c, message)
+			}
+		}
+	}
+}
+
+// keep holds on to the given message for replay; it expects the lock to be held
+func (f *Fanout[T]) keep(message T) {
+	if f.replayDepth <= 0 {
+		return
+	}
+
+	f.index++
+
+	entries := append(f.entriesBySource[f.getSource(message)], entry[T]{index: f.index, message: message})
+	if len(entries) > f.replayDepth {
+		entries = entries[len(entries)-f.replayDepth:]
+	}
+
+	f.entriesBySource[f.getSource(message)] = entries
+}
+
+// getReplay returns the messages to replay (in the order they were published); it expects the lock to be held
+func (f *Fanout[T]) getReplay(replay Replay) []T {
+	if replay.Last == 0 {
+		return []T{}
+	}
+
+	entries := make([]entry[T], 0)
+
+	for _, sourceEntries := range f.entriesBySource {
+		matchingEntries := make([]entry[T], 0)
+
+		for _, e := range sourceEntries {
+			if replay.Since != 0 && f.getTimestamp(e.message) < replay.Since {
+				continue
+			}
+
+			matchingEntries = append(matchingEntries, e)
+		}
+
+		if replay.Last > 0 && len(matchingEntries) > replay.Last {
+			matchingEntries = matchingEntries[len(matchingEntries)-replay.Last:]
+		}
+
+		entries = append(entries, matchingEntries...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].index < entries[j].index
+	})
+
+	messages := make([]T, 0, len(entries))
+	for _, e := range entries {
+		messages = append(messages, e.message)
+	}
+
+	return messages
+}
+
+func (f *Fanout[T]) drop(c *consumer[T]) {
+	c.dropped.Add(1)
+	f.dropped.Add(1)
+}
+
+func (f *Fanout[T]) publish(ctx context.Context, c *consumer[T], message T) {
+	switch c.policy {
+	case Block:
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+		case c.messages <- message:
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case <-c.done:
+				return
+			case c.messages <- message:
+				return
+			default:
+			}
+
+			// the consumer may have made room in the meantime, in which case there's nothing to drop
+			select {
+			case <-c.messages:
+				f.drop(c)
+			default:
 			}
 		}
+
+	case SpillToDisk:
+		err := c.spill.publish(message)
+		if err != nil {
+			f.drop(c)
+		}
+
+	default:
+		select {
+		case c.messages <- message:
+		default:
+			f.drop(c)
+		}
 	}
 }
 
-func (f *Fanout) Close() {
+func (f *Fanout[T]) Close() {
 	f.cancel()
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	f.consumerByConsumerID = make(map[uuid.UUID]chan managed_process.Log)
+	for _, c := range f.consumerByConsumerID {
+		c.close()
+	}
+
+	f.consumerByConsumerID = make(map[uuid.UUID]*consumer[T])
 
 	f.ctx, f.cancel = context.WithCancel(context.Background())
 }
 
-func (f *Fanout) Subscribe() (chan managed_process.Log, func()) {
+// Subscribe subscribes with the default policy (drop-newest)
+func (f *Fanout[T]) Subscribe() (chan T, func()) {
+	// the default policy can't fail
+	messages, unsubscribe, _ := f.SubscribeWithPolicy(DropNewest)
+
+	return messages, unsubscribe
+}
+
+// SubscribeWithPolicy subscribes with the given policy for when the consumer isn't keeping up
+func (f *Fanout[T]) SubscribeWithPolicy(policy Policy) (chan T, func(), error) {
+	_, messages, unsubscribe, err := f.SubscribeWithReplay(policy, Replay{})
+
+	return messages, unsubscribe, err
+}
+
+// SubscribeWithReplay subscribes with the given policy, returning the recent messages described by the given replay
+// as well; the messages that come through the channel follow on from those, with no gap or overlap
+func (f *Fanout[T]) SubscribeWithReplay(
+	policy Policy,
+	replay Replay,
+) ([]T, chan T, func(), error) {
 	consumerID := uuid.New()
-	consumer := make(chan managed_process.Log, depth)
+
+	c := &consumer[T]{
+		messages: make(chan T, depth),
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+
+	switch policy {
+	case DropNewest, DropOldest, Block:
+	case SpillToDisk:
+		var err error
+
+		c.spill, err = newSpill[T](c.messages, c.done)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown policy %#+v", policy)
+	}
 
 	f.mu.Lock()
-	f.consumerByConsumerID[consumerID] = consumer
+	replayed := f.getReplay(replay)
+	f.consumerByConsumerID[consumerID] = c
 	f.mu.Unlock()
 
 	unsubscribe := func() {
 		f.mu.Lock()
 		delete(f.consumerByConsumerID, consumerID)
 		f.mu.Unlock()
+
+		c.close()
+	}
+
+	return replayed, c.messages, unsubscribe, nil
+}
+
+// Replay returns the recent messages described by the given replay, without subscribing
+func (f *Fanout[T]) Replay(replay Replay) []T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.getReplay(replay)
+}
+
+// Dropped returns the number of messages dropped across all consumers (including those since unsubscribed)
+func (f *Fanout[T]) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// DroppedByPolicy returns the number of messages being dropped for each of the current consumers, by their policy
+func (f *Fanout[T]) DroppedByPolicy() map[Policy]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	droppedByPolicy := make(map[Policy]uint64)
+
+	for _, c := range f.consumerByConsumerID {
+		droppedByPolicy[c.policy] += c.dropped.Load()
 	}
 
-	return consumer, unsubscribe
+	return droppedByPolicy
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/initialed85/dspo/pkg/managed_process"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNew(t *testing.T) {
@@ -106,4 +107,285 @@ func TestNew(t *testing.T) {
 			assert.Equal(t, message, <-consumer3)
 		}
 	})
+
+	message := func(i int) managed_process.Log {
+		return managed_process.Log{
+			IsStdout:  true,
+			Timestamp: time.Now().UTC().UnixMilli(),
+			Seq:       uint64(i),
+			Data:      []byte(fmt.Sprintf("some data %v", i)),
+		}
+	}
+
+	receive := func(consumer chan managed_process.Log, count int) []uint64 {
+		seqs := make([]uint64, 0)
+
+		for i := 0; i < count; i++ {
+			select {
+			case l := <-consumer:
+				seqs = append(seqs, l.Seq)
+			case <-time.After(time.Second * 1):
+				return seqs
+			}
+		}
+
+		return seqs
+	}
+
+	expectedSeqs := func(from int, to int) []uint64 {
+		seqs := make([]uint64, 0)
+		for i := from; i < to; i++ {
+			seqs = append(seqs, uint64(i))
+		}
+
+		return seqs
+	}
+
+	t.Run("PolicyDropNewest", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := New(producer)
+		defer f.Close()
+
+		consumer, unsubscribe, err := f.SubscribeWithPolicy(DropNewest)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		for i := 0; i < depth+10; i++ {
+			producer <- message(i)
+		}
+
+		require.Eventually(t, func() bool { return f.Dropped() == 10 }, time.Second*1, time.Millisecond*10)
+		assert.Equal(t, map[Policy]uint64{DropNewest: 10}, f.DroppedByPolicy())
+		assert.Equal(t, expectedSeqs(0, depth), receive(consumer, depth))
+	})
+
+	t.Run("PolicyDropOldest", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := New(producer)
+		defer f.Close()
+
+		consumer, unsubscribe, err := f.SubscribeWithPolicy(DropOldest)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		for i := 0; i < depth+10; i++ {
+			producer <- message(i)
+		}
+
+		require.Eventually(t, func() bool { return f.Dropped() == 10 }, time.Second*1, time.Millisecond*10)
+		assert.Equal(t, expectedSeqs(10, depth+10), receive(consumer, depth))
+	})
+
+	t.Run("PolicyBlock", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := New(producer)
+		defer f.Close()
+
+		consumer, unsubscribe, err := f.SubscribeWithPolicy(Block)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		for i := 0; i < depth+1; i++ {
+			producer <- message(i)
+		}
+
+		select {
+		case producer <- message(depth + 1):
+			require.FailNow(t, "expected the producer to be held up")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		seqs := receive(consumer, depth+1)
+
+		producer <- message(depth + 1)
+		seqs = append(seqs, receive(consumer, 1)...)
+
+		assert.Equal(t, expectedSeqs(0, depth+2), seqs)
+		assert.Equal(t, uint64(0), f.Dropped())
+	})
+
+	t.Run("PolicySpillToDisk", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := New(producer)
+		defer f.Close()
+
+		consumer, unsubscribe, err := f.SubscribeWithPolicy(SpillToDisk)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		// a slow consumer alongside shouldn't hold anything up
+		_, unsubscribeSlow, err := f.SubscribeWithPolicy(SpillToDisk)
+		require.NoError(t, err)
+		defer unsubscribeSlow()
+
+		for i := 0; i < depth*3; i++ {
+			producer <- message(i)
+		}
+
+		seqs := receive(consumer, depth*2)
+
+		for i := depth * 3; i < depth*4; i++ {
+			producer <- message(i)
+		}
+
+		seqs = append(seqs, receive(consumer, depth*2)...)
+
+		assert.Equal(t, expectedSeqs(0, depth*4), seqs)
+		assert.Equal(t, uint64(0), f.Dropped())
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := NewLogFanout(producer, 10)
+		defer f.Close()
+
+		for i := 0; i < 30; i++ {
+			l := message(i)
+			l.Name = fmt.Sprintf("service_%v", i%2)
+			l.Timestamp = int64(i)
+			producer <- l
+		}
+
+		getSeqs := func(logs []managed_process.Log) []uint64 {
+			seqs := make([]uint64, 0)
+			for _, l := range logs {
+				seqs = append(seqs, l.Seq)
+			}
+
+			return seqs
+		}
+
+		// the last one may still be on its way through
+		require.Eventually(t, func() bool { return len(f.Replay(Replay{Last: -1})) == 20 }, time.Second, time.Millisecond)
+
+		assert.Empty(t, f.Replay(Replay{}))
+		assert.Equal(t, expectedSeqs(10, 30), getSeqs(f.Replay(Replay{Last: -1})))
+		assert.Equal(t, expectedSeqs(26, 30), getSeqs(f.Replay(Replay{Last: 2})))
+		assert.Equal(t, expectedSeqs(25, 30), getSeqs(f.Replay(Replay{Last: -1, Since: 25})))
+		assert.Equal(t, []uint64{28, 29}, getSeqs(f.Replay(Replay{Last: 1, Since: 25})))
+
+		replayed, consumer, unsubscribe, err := f.SubscribeWithReplay(DropNewest, Replay{Last: 1})
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		assert.Equal(t, []uint64{28, 29}, getSeqs(replayed))
+
+		producer <- message(30)
+		assert.Equal(t, []uint64{30}, receive(consumer, 1))
+
+		// nothing is kept without a replay depth
+		f = New(producer)
+		defer f.Close()
+
+		producer <- message(0)
+		producer <- message(1)
+		assert.Empty(t, f.Replay(Replay{Last: -1}))
+	})
+
+	t.Run("ReplayWithoutGapsOrOverlaps", func(t *testing.T) {
+		producer := make(chan managed_process.Log)
+		f := NewLogFanout(producer, 100000)
+		defer f.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			for i := 0; i < 10000; i++ {
+				producer <- message(i)
+			}
+		}()
+
+		time.Sleep(time.Millisecond * 5)
+
+		replayed, consumer, unsubscribe, err := f.SubscribeWithReplay(Block, Replay{Last: -1})
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		seqs := make([]uint64, 0)
+		for _, l := range replayed {
+			seqs = append(seqs, l.Seq)
+		}
+
+		seqs = append(seqs, receive(consumer, 10000-len(replayed))...)
+
+		<-done
+
+		assert.Equal(t, expectedSeqs(0, 10000), seqs)
+	})
+
+	t.Run("OtherMessageTypes", func(t *testing.T) {
+		type event struct {
+			Source string
+			At     int64
+			N      int
+		}
+
+		producer := make(chan event)
+		f := NewWithReplay(
+			producer,
+			2,
+			func(e event) string { return e.Source },
+			func(e event) int64 { return e.At },
+		)
+		defer f.Close()
+
+		consumer, unsubscribe, err := f.SubscribeWithPolicy(SpillToDisk)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		for i := 0; i < depth*2; i++ {
+			producer <- event{Source: fmt.Sprintf("source_%v", i%2), At: int64(i), N: i}
+		}
+
+		for i := 0; i < depth*2; i++ {
+			select {
+			case e := <-consumer:
+				require.Equal(t, i, e.N)
+			case <-time.After(time.Second * 1):
+				require.FailNow(t, "timed out waiting for events")
+			}
+		}
+
+		assert.Equal(
+			t,
+			[]event{{Source: "source_1", At: depth*2 - 1, N: depth*2 - 1}},
+			f.Replay(Replay{Last: -1, Since: depth*2 - 1}),
+		)
+		assert.Len(t, f.Replay(Replay{Last: -1}), 4)
+
+		// without a replay depth there's no need to say how to replay
+		numbers := make(chan int)
+		g := New(numbers)
+		defer g.Close()
+
+		numberConsumer, unsubscribeNumbers := g.Subscribe()
+		defer unsubscribeNumbers()
+
+		numbers <- 42
+		assert.Equal(t, 42, <-numberConsumer)
+	})
+
+	t.Run("ParsePolicy", func(t *testing.T) {
+		for raw, expected := range map[string]Policy{
+			"":              DropNewest,
+			"drop-newest":   DropNewest,
+			"drop-oldest":   DropOldest,
+			"block":         Block,
+			"spill-to-disk": SpillToDisk,
+		} {
+			policy, err := ParsePolicy(raw)
+			require.NoError(t, err, raw)
+			assert.Equal(t, expected, policy, raw)
+		}
+
+		_, err := ParsePolicy("sometimes")
+		assert.Error(t, err)
+
+		f := New(make(chan managed_process.Log))
+		defer f.Close()
+
+		_, _, err = f.SubscribeWithPolicy("sometimes")
+		assert.Error(t, err)
+	})
 }
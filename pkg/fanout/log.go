@@ -0,0 +1,22 @@
+package fanout
+
+import (
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+// LogFanout is a Fanout for the logs of managed processes, which are replayed per service
+type LogFanout = Fanout[managed_process.Log]
+
+// NewLogFanout returns a fanout for the logs of managed processes that keeps the last replayDepth logs for each
+// service
+func NewLogFanout(messages chan managed_process.Log, replayDepth int) *LogFanout {
+	return NewWithReplay(messages, replayDepth, getLogSource, getLogTimestamp)
+}
+
+func getLogSource(l managed_process.Log) string {
+	return l.Name
+}
+
+func getLogTimestamp(l managed_process.Log) int64 {
+	return l.Timestamp
+}
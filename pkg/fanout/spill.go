@@ -0,0 +1,175 @@
+package fanout
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// spill sits in front of a consumer's buffer; once the buffer is full, messages go to a temp file (as JSON lines) and
+// are fed back into the buffer in order as the consumer makes room, until it's caught up and the file can be emptied
+type spill[T any] struct {
+	messages chan T
+	done     chan struct{}
+	notify   chan struct{}
+	mu       sync.Mutex
+	file     *os.File
+	reader   *bufio.Reader
+	pending  int
+	closed   bool
+}
+
+func newSpill[T any](messages chan T, done chan struct{}) (*spill[T], error) {
+	file, err := os.CreateTemp("", "dspo-spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing else needs to find it, so it's cleaned up even if we don't get the chance
+	_ = os.Remove(file.Name())
+
+	s := spill[T]{
+		messages: messages,
+		done:     done,
+		notify:   make(chan struct{}, 1),
+		file:     file,
+		reader:   bufio.NewReader(io.NewSectionReader(file, 0, 1<<62)),
+	}
+
+	go s.runDrain()
+
+	return &s, nil
+}
+
+func (s *spill[T]) publish(message T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	// anything that's already spilled has to go first
+	if s.pending == 0 {
+		select {
+		case s.messages <- message:
+			return nil
+		default:
+		}
+	}
+
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	s.pending++
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// next returns the oldest spilled message, if there is one
+func (s *spill[T]) next() (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var message T
+
+	if s.closed || s.pending == 0 {
+		return message, false
+	}
+
+	b, err := s.reader.ReadBytes('\n')
+
+	// a read-ahead that got to the end of the file before more was written leaves the end of the file to be reported
+	// on the next read, which should be tried again now that there's more
+	if errors.Is(err, io.EOF) && len(b) == 0 {
+		b, err = s.reader.ReadBytes('\n')
+	}
+
+	if err == nil {
+		err = json.Unmarshal(b, &message)
+	}
+
+	// the file is ours alone, so this shouldn't happen; the best we can do is to start again with an empty file
+	if err != nil {
+		s.pending = 0
+		s.reset()
+		return message, false
+	}
+
+	return message, true
+}
+
+// sent is called once a spilled message has made it into the buffer
+func (s *spill[T]) sent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.pending--
+
+	if s.pending == 0 {
+		s.reset()
+	}
+}
+
+// reset empties the file; it expects the lock to be held
+func (s *spill[T]) reset() {
+	_ = s.file.Truncate(0)
+	_, _ = s.file.Seek(0, io.SeekStart)
+	s.reader.Reset(io.NewSectionReader(s.file, 0, 1<<62))
+}
+
+func (s *spill[T]) runDrain() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		}
+
+		for {
+			message, ok := s.next()
+			if !ok {
+				break
+			}
+
+			select {
+			case <-s.done:
+				return
+			case s.messages <- message:
+				s.sent()
+			}
+		}
+	}
+}
+
+func (s *spill[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+
+	_ = s.file.Close()
+}
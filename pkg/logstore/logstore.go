@@ -0,0 +1,488 @@
+package logstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/dspo/internal"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+const (
+	DefaultMaxSize     = 1024 * 1024 * 10
+	DefaultMaxAge      = time.Hour * 24
+	DefaultMaxSegments = 10
+	currentFileName    = "current.jsonl"
+	rotatedSuffix      = ".jsonl"
+	compressedSuffix   = ".jsonl.gz"
+	maxSweepInterval   = time.Minute
+)
+
+// segment is the file currently being written to for a service
+type segment struct {
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// Store writes the logs for each service (as JSON lines) to a dir of its own under the given dir; the current segment
+// is rotated once it gets too big or too old, with the rotated segments compressed and only the most recent kept
+type Store struct {
+	dir           string
+	maxSize       int64
+	maxAge        time.Duration
+	maxSegments   int
+	subscribe     func(policy fanout.Policy) (chan managed_process.Log, func(), error)
+	segmentByName map[string]*segment
+	mu            sync.Mutex
+	wg            sync.WaitGroup
+	compressWg    sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	logger        *slog.Logger
+}
+
+func New(
+	dir string,
+	maxSize int64,
+	maxAge time.Duration,
+	maxSegments int,
+	subscribe func(policy fanout.Policy) (chan managed_process.Log, func(), error),
+	name string,
+) *Store {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+
+	if maxSegments <= 0 {
+		maxSegments = DefaultMaxSegments
+	}
+
+	s := Store{
+		dir:           dir,
+		maxSize:       maxSize,
+		maxAge:        maxAge,
+		maxSegments:   maxSegments,
+		subscribe:     subscribe,
+		segmentByName: make(map[string]*segment),
+		logger:        internal.GetLogger(name),
+	}
+
+	return &s
+}
+
+// Start subscribes to the logs (e.g. those of a system.System) with the subscribe func it was given; it should be called
+// before whatever produces the logs is started so as not to miss anything
+func (s *Store) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return fmt.Errorf("already started")
+	}
+
+	err := os.MkdirAll(s.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// writing to disk doesn't take long, and nothing can be written after the fact if it's dropped
+	logs, unsubscribe, err := s.subscribe(fanout.Block)
+	if err != nil {
+		return err
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(1)
+	go s.runWrite(s.ctx, logs, unsubscribe)
+
+	s.logger.Debug("started", "dir", s.dir)
+
+	return nil
+}
+
+// Stop writes out whatever is still buffered and closes the current segments; it should be called after whatever
+// produces the logs is stopped so as to catch the last of the logs
+func (s *Store) Stop() error {
+	s.mu.Lock()
+
+	if s.cancel == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("not started")
+	}
+
+	s.cancel()
+	s.cancel = nil
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.compressWg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, current := range s.segmentByName {
+		_ = current.file.Close()
+		delete(s.segmentByName, name)
+	}
+
+	s.logger.Debug("stopped")
+
+	return nil
+}
+
+func (s *Store) runWrite(ctx context.Context, logs chan managed_process.Log, unsubscribe func()) {
+	defer s.wg.Done()
+	defer unsubscribe()
+
+	write := func(l managed_process.Log) {
+		err := s.write(l)
+		if err != nil {
+			s.logger.Error("failed to write log", "service", l.Name, "error", err)
+		}
+	}
+
+	// a service that's gone quiet doesn't write anything to trigger a rotation, so check in on them every so often
+	sweepInterval := s.maxAge / 10
+	if sweepInterval > maxSweepInterval {
+		sweepInterval = maxSweepInterval
+	}
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.sweep()
+			if err != nil {
+				s.logger.Error("failed to sweep segments", "error", err)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case l := <-logs:
+					write(l)
+				default:
+					return
+				}
+			}
+		case l := <-logs:
+			write(l)
+		}
+	}
+}
+
+func (s *Store) write(l managed_process.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.getSegment(l.Name)
+	if err != nil {
+		return err
+	}
+
+	if current.size >= s.maxSize || time.Since(current.openedAt) >= s.maxAge {
+		err = s.rotate(l.Name, current)
+		if err != nil {
+			return err
+		}
+
+		current, err = s.getSegment(l.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	n, err := current.file.Write(append(b, '\n'))
+	current.size += int64(n)
+
+	return err
+}
+
+// sweep rotates the current segment for any service (written to by this store or left behind by a previous one) that
+// has gotten too old, and prunes the rotated segments for all of them
+func (s *Store) sweep() error {
+	names, err := Names(s.dir)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		serviceDir := getServiceDir(s.dir, name)
+
+		current, ok := s.segmentByName[name]
+		if ok {
+			if current.size > 0 && time.Since(current.openedAt) >= s.maxAge {
+				err = s.rotate(name, current)
+				if err != nil {
+					s.logger.Error("failed to rotate segment", "service", name, "error", err)
+				}
+
+				// rotating prunes once the segment has been compressed
+				continue
+			}
+		} else {
+			first, readErr := readFirst(filepath.Join(serviceDir, currentFileName))
+			if readErr == nil && time.Since(time.UnixMilli(first.Timestamp)) >= s.maxAge {
+				err = s.rotateFile(name)
+				if err != nil {
+					s.logger.Error("failed to rotate segment", "service", name, "error", err)
+				}
+
+				continue
+			}
+		}
+
+		err = prune(serviceDir, s.maxSegments)
+		if err != nil {
+			s.logger.Error("failed to prune segments", "service", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// getSegment returns the current segment for the given service, opening (and if need be creating) it; it expects the
+// lock to be held
+func (s *Store) getSegment(name string) (*segment, error) {
+	current, ok := s.segmentByName[name]
+	if ok {
+		return current, nil
+	}
+
+	serviceDir := getServiceDir(s.dir, name)
+
+	err := os.MkdirAll(serviceDir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(serviceDir, currentFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	current = &segment{
+		file:     file,
+		size:     info.Size(),
+		openedAt: time.Now(),
+	}
+
+	// a segment left behind by a previous supervisor is as old as its first log
+	if info.Size() > 0 {
+		first, err := readFirst(filepath.Join(serviceDir, currentFileName))
+		if err == nil {
+			current.openedAt = time.UnixMilli(first.Timestamp)
+		}
+	}
+
+	s.segmentByName[name] = current
+
+	return current, nil
+}
+
+// rotate moves the current segment aside (named for when it was rotated, so that the segments sort oldest first) and
+// compresses it in the background; it expects the lock to be held
+func (s *Store) rotate(name string, current *segment) error {
+	delete(s.segmentByName, name)
+
+	err := current.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.rotateFile(name)
+}
+
+// rotateFile does the work of rotate for a current segment that isn't open; it expects the lock to be held
+func (s *Store) rotateFile(name string) error {
+	serviceDir := getServiceDir(s.dir, name)
+	rotatedPath := filepath.Join(serviceDir, fmt.Sprintf("%020d%v", time.Now().UnixNano(), rotatedSuffix))
+
+	err := os.Rename(filepath.Join(serviceDir, currentFileName), rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	s.compressWg.Add(1)
+	go func() {
+		defer s.compressWg.Done()
+
+		err := compress(rotatedPath)
+		if err != nil {
+			s.logger.Error("failed to compress segment", "path", rotatedPath, "error", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		err = prune(serviceDir, s.maxSegments)
+		if err != nil {
+			s.logger.Error("failed to prune segments", "service", name, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func getServiceDir(dir string, name string) string {
+	return filepath.Join(dir, url.PathEscape(name))
+}
+
+// compress replaces the given (rotated) segment with a gzipped copy of it
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	compressedPath := strings.TrimSuffix(path, rotatedSuffix) + compressedSuffix
+	tempPath := compressedPath + ".tmp"
+
+	dst, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, compressedPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// prune removes all but the most recent of the rotated segments in the given service dir
+func prune(serviceDir string, maxSegments int) error {
+	paths, err := getRotated(serviceDir)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) <= maxSegments {
+		return nil
+	}
+
+	for _, path := range paths[:len(paths)-maxSegments] {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getRotated returns the paths to the rotated segments (compressed or not) in the given service dir, oldest first
+func getRotated(serviceDir string) ([]string, error) {
+	entries, err := os.ReadDir(serviceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	compressedByName := make(map[string]bool)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), compressedSuffix) {
+			compressedByName[entry.Name()] = true
+		}
+	}
+
+	paths := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.Name() == currentFileName {
+			continue
+		}
+
+		if !strings.HasSuffix(entry.Name(), rotatedSuffix) && !strings.HasSuffix(entry.Name(), compressedSuffix) {
+			continue
+		}
+
+		// a segment that's just been compressed, the original of which is on its way out
+		if strings.HasSuffix(entry.Name(), rotatedSuffix) &&
+			compressedByName[strings.TrimSuffix(entry.Name(), rotatedSuffix)+compressedSuffix] {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(serviceDir, entry.Name()))
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func readFirst(path string) (managed_process.Log, error) {
+	l := managed_process.Log{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return l, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return l, err
+	}
+
+	err = json.Unmarshal(line, &l)
+
+	return l, err
+}
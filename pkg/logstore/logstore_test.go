@@ -0,0 +1,244 @@
+package logstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getServiceArgs(name string, command string) common.ServiceArgs {
+	return common.ServiceArgs{
+		Name: name,
+		ManagedProcessArgs: common.ManagedProcessArgs{
+			RestartPolicy: managed_process.Never,
+			Shell:         "/bin/bash",
+			Command:       command,
+		},
+	}
+}
+
+// run runs the given services to completion with a store writing to the given dir
+func run(t *testing.T, dir string, maxSize int64, maxSegments int, serviceArgs ...common.ServiceArgs) {
+	s := system.New(serviceArgs, "test")
+
+	store := New(dir, maxSize, 0, maxSegments, s.SubscribeToLogsWithPolicy, "test_logstore")
+	require.NoError(t, store.Start())
+
+	require.NoError(t, s.Start())
+
+	require.Eventually(
+		t,
+		func() bool {
+			for _, actualService := range s.ServiceByName() {
+				if actualService.Running() {
+					return false
+				}
+			}
+
+			return true
+		},
+		time.Second*5,
+		time.Millisecond*10,
+	)
+
+	require.NoError(t, s.Stop())
+	require.NoError(t, store.Stop())
+}
+
+func getDatas(logs []managed_process.Log) []string {
+	datas := make([]string, 0)
+	for _, l := range logs {
+		datas = append(datas, string(l.Data))
+	}
+
+	return datas
+}
+
+func getLines(from int, to int) []string {
+	lines := make([]string, 0)
+	for i := from; i <= to; i++ {
+		lines = append(lines, fmt.Sprintf("line %v\n", i))
+	}
+
+	return lines
+}
+
+func TestNew(t *testing.T) {
+	t.Run("WriteAndRead", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+
+		run(
+			t,
+			dir,
+			0,
+			0,
+			getServiceArgs("service_a", "for i in $(seq 1 10); do echo \"line $i\"; done"),
+			getServiceArgs("service/b", "echo 'hello'; echo 'world' >&2"),
+		)
+
+		names, err := Names(dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"service/b", "service_a"}, names)
+
+		logs, err := Read(dir, []string{"service_a"}, Query{})
+		require.NoError(t, err)
+		assert.Equal(t, getLines(1, 10), getDatas(logs))
+
+		for i, l := range logs {
+			assert.Equal(t, "service_a", l.Name)
+			assert.Equal(t, uint64(i+1), l.Seq)
+		}
+
+		logs, err = Read(dir, []string{"service/b"}, Query{})
+		require.NoError(t, err)
+		require.Len(t, logs, 2)
+		assert.ElementsMatch(t, []string{"hello\n", "world\n"}, getDatas(logs))
+
+		logs, err = Read(dir, nil, Query{})
+		require.NoError(t, err)
+		assert.Len(t, logs, 12)
+
+		logs, err = Read(dir, []string{"service_a"}, Query{Tail: 3})
+		require.NoError(t, err)
+		assert.Equal(t, getLines(8, 10), getDatas(logs))
+
+		logs, err = Read(dir, []string{"service_a"}, Query{Since: time.Now().Add(time.Hour).UnixMilli()})
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+
+		logs, err = Read(dir, []string{"service_a"}, Query{Until: 1})
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+
+		// another run appends to what's there
+		run(t, dir, 0, 0, getServiceArgs("service_a", "echo 'line 11'"))
+
+		logs, err = Read(dir, []string{"service_a"}, Query{})
+		require.NoError(t, err)
+		assert.Equal(t, getLines(1, 11), getDatas(logs))
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+
+		run(t, dir, 1024, 3, getServiceArgs("service_a", "for i in $(seq 1 100); do echo \"line $i\"; done"))
+
+		entries, err := os.ReadDir(filepath.Join(dir, "service_a"))
+		require.NoError(t, err)
+
+		compressed := 0
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), compressedSuffix) {
+				compressed++
+				continue
+			}
+
+			require.Equal(t, currentFileName, entry.Name())
+		}
+		assert.Equal(t, 3, compressed)
+
+		// only the most recent segments are kept, so only the most recent logs are there to be read
+		logs, err := Read(dir, []string{"service_a"}, Query{})
+		require.NoError(t, err)
+		require.Greater(t, len(logs), 10)
+		require.Less(t, len(logs), 100)
+		assert.Equal(t, getLines(100-len(logs)+1, 100), getDatas(logs))
+
+		logs, err = Read(dir, []string{"service_a"}, Query{Tail: 5})
+		require.NoError(t, err)
+		assert.Equal(t, getLines(96, 100), getDatas(logs))
+	})
+
+	t.Run("RotationWhileQuiet", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+
+		// a service that's long gone from the config, with more segments than are to be kept
+		quietDir := filepath.Join(dir, "service_b")
+		require.NoError(t, os.MkdirAll(quietDir, 0o755))
+		for i := 1; i <= 5; i++ {
+			path := filepath.Join(quietDir, fmt.Sprintf("%020d%v", i, rotatedSuffix))
+			require.NoError(t, os.WriteFile(path, []byte("{}\n"), 0o644))
+		}
+
+		logs := make(chan managed_process.Log, 1)
+
+		store := New(
+			dir,
+			0,
+			time.Millisecond*100,
+			3,
+			func(policy fanout.Policy) (chan managed_process.Log, func(), error) {
+				return logs, func() {}, nil
+			},
+			"test_logstore",
+		)
+		require.NoError(t, store.Start())
+		defer func() {
+			_ = store.Stop()
+		}()
+
+		logs <- managed_process.Log{Name: "service_a", Timestamp: time.Now().UnixMilli(), Data: []byte("hello\n")}
+
+		// nothing else gets written, but the segment gets rotated anyway
+		require.Eventually(
+			t,
+			func() bool {
+				paths, err := getRotated(filepath.Join(dir, "service_a"))
+				return err == nil && len(paths) == 1 && strings.HasSuffix(paths[0], compressedSuffix)
+			},
+			time.Second*5,
+			time.Millisecond*10,
+		)
+
+		read, err := Read(dir, []string{"service_a"}, Query{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"hello\n"}, getDatas(read))
+
+		paths, err := getRotated(quietDir)
+		require.NoError(t, err)
+		assert.Len(t, paths, 3)
+	})
+
+	t.Run("TailReadsNewestFirst", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+
+		run(t, dir, 1024, 10, getServiceArgs("service_a", "for i in $(seq 1 100); do echo \"line $i\"; done"))
+
+		// an oldest segment that can't be read at all
+		path := filepath.Join(dir, "service_a", fmt.Sprintf("%020d%v", 1, compressedSuffix))
+		require.NoError(t, os.Symlink(path, path))
+
+		logs, err := Read(dir, []string{"service_a"}, Query{Tail: 5})
+		require.NoError(t, err)
+		assert.Equal(t, getLines(96, 100), getDatas(logs))
+
+		_, err = Read(dir, []string{"service_a"}, Query{})
+		require.Error(t, err)
+	})
+
+	t.Run("ReadNothing", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+
+		names, err := Names(dir)
+		require.NoError(t, err)
+		assert.Empty(t, names)
+
+		logs, err := Read(dir, nil, Query{})
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+
+		logs, err = Read(dir, []string{"service_a"}, Query{})
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+	})
+}
@@ -0,0 +1,243 @@
+package logstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+// Query bounds the logs read from a store
+type Query struct {
+	// Since and Until (both inclusive and in unix milliseconds, as per managed_process.Log) bound the logs read; 0 means
+	// unbounded
+	Since int64
+	Until int64
+	// Tail limits the logs read to the last Tail logs per service; 0 means all of them
+	Tail int
+}
+
+func (q Query) matches(l managed_process.Log) bool {
+	if q.Since != 0 && l.Timestamp < q.Since {
+		return false
+	}
+
+	if q.Until != 0 && l.Timestamp > q.Until {
+		return false
+	}
+
+	return true
+}
+
+// Names returns the (sorted) names of the services that have logs in the store in the given dir
+func Names(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	names := make([]string, 0)
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Read returns the matching logs for the given services (or all of them if none are given) from the store in the
+// given dir, oldest first; it's safe to call while the store is being written to
+func Read(dir string, names []string, query Query) ([]managed_process.Log, error) {
+	var err error
+
+	if len(names) == 0 {
+		names, err = Names(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logs := make([]managed_process.Log, 0)
+
+	for _, name := range names {
+		serviceLogs, err := readService(getServiceDir(dir, name), query)
+		if err != nil {
+			return nil, err
+		}
+
+		logs = append(logs, serviceLogs...)
+	}
+
+	Sort(logs)
+
+	return logs, nil
+}
+
+// Sort sorts the given logs oldest first; logs within the same millisecond are sorted by service name and then by
+// sequence number
+func Sort(logs []managed_process.Log) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].Timestamp != logs[j].Timestamp {
+			return logs[i].Timestamp < logs[j].Timestamp
+		}
+
+		if logs[i].Name != logs[j].Name {
+			return logs[i].Name < logs[j].Name
+		}
+
+		return logs[i].Seq < logs[j].Seq
+	})
+}
+
+func readService(serviceDir string, query Query) ([]managed_process.Log, error) {
+	paths, err := getRotated(serviceDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []managed_process.Log{}, nil
+		}
+
+		return nil, err
+	}
+
+	// segments are named for when they were rotated, so anything older than that has nothing to offer
+	if query.Since != 0 {
+		for len(paths) > 0 && getRotatedAt(paths[0]) < query.Since {
+			paths = paths[1:]
+		}
+	}
+
+	paths = append(paths, filepath.Join(serviceDir, currentFileName))
+
+	// read the newest segments first so as to stop as soon as there's enough for the tail
+	segmentLogs := make([][]managed_process.Log, 0)
+	count := 0
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		logs := make([]managed_process.Log, 0)
+
+		err = readSegment(paths[i], func(l managed_process.Log) {
+			if !query.matches(l) {
+				return
+			}
+
+			logs = append(logs, l)
+
+			// no sense holding on to more than we're going to return
+			if query.Tail > 0 && len(logs) > query.Tail*2 {
+				logs = append(logs[:0], logs[len(logs)-query.Tail:]...)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		segmentLogs = append(segmentLogs, logs)
+		count += len(logs)
+
+		if query.Tail > 0 && count >= query.Tail {
+			break
+		}
+	}
+
+	logs := make([]managed_process.Log, 0, count)
+
+	for i := len(segmentLogs) - 1; i >= 0; i-- {
+		logs = append(logs, segmentLogs[i]...)
+	}
+
+	if query.Tail > 0 && len(logs) > query.Tail {
+		logs = logs[len(logs)-query.Tail:]
+	}
+
+	return logs, nil
+}
+
+// getRotatedAt returns when the given rotated segment was rotated (in unix milliseconds), from its name
+func getRotatedAt(path string) int64 {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, compressedSuffix), rotatedSuffix)
+
+	rotatedAt, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return rotatedAt / 1000000
+}
+
+// readSegment calls the given func for each log in the given segment; a segment that has gone away (e.g. rotated or
+// pruned since it was listed) has nothing to offer, as does a line that doesn't parse (e.g. one that's half-written)
+func readSegment(path string, onLog func(managed_process.Log)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// a rotated segment may have been compressed in the meantime
+			if strings.HasSuffix(path, rotatedSuffix) && filepath.Base(path) != currentFileName {
+				return readSegment(strings.TrimSuffix(path, rotatedSuffix)+compressedSuffix, onLog)
+			}
+
+			return nil
+		}
+
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var r io.Reader = file
+
+	if strings.HasSuffix(path, compressedSuffix) {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil
+		}
+		defer func() {
+			_ = gzipReader.Close()
+		}()
+
+		r = gzipReader
+	}
+
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			l := managed_process.Log{}
+
+			if json.Unmarshal(line, &l) == nil {
+				onLog(l)
+			}
+		}
+
+		if err != nil {
+			// a truncated compressed segment is as good as it gets
+			return nil
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package managed_process
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/process"
+)
+
+const (
+	historyDepth = 32
+)
+
+var (
+	cgroupRoot = "/sys/fs/cgroup" // a var so that the tests can take the cgroup's OOM kill count away
+)
+
+// Run describes a single run of the process
+type Run struct {
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`         // the zero time while still running
+	ExitCode  int       `json:"exit_code"`        // -1 if terminated by a signal (or never started)
+	Signal    int       `json:"signal,omitempty"` // the signal that terminated the process, if any
+	Stopped   bool      `json:"stopped"`          // whether dspo brought about the exit (i.e. by stopping it)
+	OOMKilled bool      `json:"oom_killed"`       // a best guess at whether the process was killed for running out of memory
+	TimedOut  bool      `json:"timed_out"`        // whether the process was killed for outliving the run timeout
+	Error     string    `json:"error,omitempty"`  // e.g. if the process couldn't be started at all
+	oomKills  int       // the cgroup's oom kill count when the process was started (-1 if unknown)
+}
+
+// Ended reports whether the run has finished
+func (r Run) Ended() bool {
+	return !r.EndedAt.IsZero()
+}
+
+// getOOMKills returns the number of OOM kills in our cgroup (which our processes share) so far, or -1 if that can't be
+// found out (e.g. not cgroup v2)
+func getOOMKills() int {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return -1
+	}
+
+	// cgroup v2 has a single line of the form 0::/some/path
+	cgroupPath := ""
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			cgroupPath = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+
+	if cgroupPath == "" {
+		return -1
+	}
+
+	f, err := os.Open(filepath.Join(cgroupRoot, cgroupPath, "memory.events"))
+	if err != nil {
+		return -1
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+
+		oomKills, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return -1
+		}
+
+		return oomKills
+	}
+
+	return -1
+}
+
+// startRun records the start of a run of the given process; it expects the lock to be held
+func (m *ManagedProcess) startRun(p *process.Process) {
+	run := Run{
+		StartedAt: p.StartedAt(),
+		ExitCode:  -1,
+		oomKills:  getOOMKills(),
+	}
+
+	if run.StartedAt.IsZero() {
+		run.StartedAt = time.Now()
+	}
+
+	m.history = append(m.history, run)
+	if len(m.history) > historyDepth {
+		m.history = m.history[len(m.history)-historyDepth:]
+	}
+
+	m.runProcess = p
+}
+
+// endRun records the end of the run of the given process (if it's the current run and hasn't already been ended); it
+// expects the lock to be held
+func (m *ManagedProcess) endRun(p *process.Process, stopped bool) {
+	if m.runProcess != p || len(m.history) == 0 {
+		return
+	}
+
+	m.runProcess = nil
+
+	run := &m.history[len(m.history)-1]
+
+	run.EndedAt = p.EndedAt()
+	if run.EndedAt.IsZero() {
+		run.EndedAt = time.Now()
+	}
+
+	run.ExitCode = p.ReturnCode()
+	run.Signal = int(p.Signal())
+	run.Stopped = stopped
+
+	err := p.Error()
+	if err != nil && p.StartedAt().IsZero() {
+		run.Error = err.Error()
+	}
+
+	// the kernel's OOM killer uses SIGKILL, but so do we (which we know about) and so might anyone else; it's only
+	// taken to be the OOM killer if the cgroup's OOM kill count is available and has gone up
+	if p.Signal() == syscall.SIGKILL && !stopped && run.oomKills >= 0 {
+		run.OOMKilled = getOOMKills() > run.oomKills
+	}
+}
+
+// History returns the most recent runs (oldest first), including the current one if there is one
+func (m *ManagedProcess) History() []Run {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := make([]Run, len(m.history))
+	copy(history, m.history)
+
+	return history
+}
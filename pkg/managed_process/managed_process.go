@@ -1,12 +1,19 @@
 package managed_process
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/rand"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/initialed85/dspo/internal"
@@ -16,19 +23,109 @@ import (
 type RestartPolicy string
 
 const (
-	Never            RestartPolicy = "no"
-	UnlessStopped    RestartPolicy = "unless-stopped"
-	OnFailure        RestartPolicy = "on-failure"
-	bufferSize                     = 1024
-	internalLogDepth               = 1024
+	Never  RestartPolicy = "no"
+	Always RestartPolicy = "always"
+	// UnlessStopped behaves as Always as far as a ManagedProcess goes; the difference (that a manual stop is remembered
+	// across supervisor restarts) is up to whoever is doing the stopping
+	UnlessStopped RestartPolicy = "unless-stopped"
+	OnFailure     RestartPolicy = "on-failure"
 )
 
+const (
+	bufferSize       = 1024
+	maxLineLength    = 16384
+	lineIdleTimeout  = time.Millisecond * 100
+	internalLogDepth = 1024
+	flushTimeout     = time.Second * 1
+	flushInterval    = time.Millisecond * 10
+)
+
+const (
+	DefaultStopSignal      = syscall.SIGTERM
+	DefaultStopGracePeriod = time.Second * 10
+	DefaultCrashLoopExits  = 3
+	DefaultCrashLoopWindow = time.Minute * 1
+)
+
+// ParseRestartPolicy parses a docker compose style restart policy (no, always, unless-stopped or on-failure[:max]); the
+// returned max restarts is 0 (no limit) unless given as part of on-failure
+func ParseRestartPolicy(raw string) (RestartPolicy, int, error) {
+	raw = strings.TrimSpace(raw)
+
+	name, rawMaxRestarts, hasMaxRestarts := strings.Cut(raw, ":")
+
+	restartPolicy := RestartPolicy(name)
+
+	switch restartPolicy {
+	case "":
+		restartPolicy = Never
+	case Never, Always, UnlessStopped, OnFailure:
+	default:
+		return "", 0, fmt.Errorf("unknown restart policy %#+v", raw)
+	}
+
+	if !hasMaxRestarts {
+		return restartPolicy, 0, nil
+	}
+
+	if restartPolicy != OnFailure {
+		return "", 0, fmt.Errorf("only %v takes a max restarts, not %#+v", OnFailure, raw)
+	}
+
+	maxRestarts, err := strconv.Atoi(rawMaxRestarts)
+	if err != nil || maxRestarts <= 0 {
+		return "", 0, fmt.Errorf("max restarts for %v must be a positive number, not %#+v", OnFailure, rawMaxRestarts)
+	}
+
+	return restartPolicy, maxRestarts, nil
+}
+
+// Backoff describes how the wait between restarts grows; the first wait is the restart wait duration, and the zero
+// value means a fixed wait
+type Backoff struct {
+	Multiplier  float64       // applied to the wait after each restart; anything up to 1 means no growth
+	Max         time.Duration // the wait never grows beyond this; 0 means no limit
+	Jitter      float64       // the wait is randomly adjusted by up to this fraction of itself (e.g. 0.1 for +/- 10%)
+	ResetWindow time.Duration // a process that stays up for this long clears the backoff (and restart count); 0 means never
+}
+
+// wait returns how long to wait before the given restart (0 being the first since the last reset)
+func (b Backoff) wait(initial time.Duration, restarts int) time.Duration {
+	wait := float64(initial)
+
+	if b.Multiplier > 1 {
+		wait *= math.Pow(b.Multiplier, float64(restarts))
+	}
+
+	if b.Max > 0 && wait > float64(b.Max) {
+		wait = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		wait += wait * b.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return time.Duration(wait)
+}
+
+// CrashLoop describes when a process is considered to be crash looping (i.e. at least Exits exits within Window); the
+// zero value means the defaults and a negative Exits disables the detection
+type CrashLoop struct {
+	Exits  int
+	Window time.Duration
+}
+
 type Log struct {
 	Name      string
 	IsStdout  bool
 	IsStderr  bool
 	Timestamp int64
-	Data      []byte
+	Seq       uint64 // increases with each log for a given ManagedProcess, across restarts
+	Data      []byte // a line (with its newline), or part of one if it was too long or not finished in time
 }
 
 type ManagedProcess struct {
@@ -36,43 +133,102 @@ type ManagedProcess struct {
 	restartPolicy       RestartPolicy
 	shell               string
 	command             string
+	argv                []string
 	env                 []string
 	inheritEnv          bool
+	attributes          process.Attributes
 	restartWaitDuration time.Duration
+	backoff             Backoff
+	maxRestarts         int
+	crashLoop           CrashLoop
+	stopSignal          syscall.Signal
+	stopGracePeriod     time.Duration
+	runTimeout          time.Duration
 	onExit              func(int)
 	internalLogs        chan Log
+	pendingLogs         atomic.Int64
+	seq                 atomic.Uint64
+	readers             *sync.WaitGroup
 	stdoutReader        io.ReadCloser
 	stdoutWriter        io.WriteCloser
 	stderrReader        io.ReadCloser
 	stderrWriter        io.WriteCloser
 	mu                  *sync.Mutex
 	running             bool
+	failed              bool
+	restarts            int
+	exitTimestamps      []time.Time
+	history             []Run
+	runProcess          *process.Process
 	process             *process.Process
+	stopping            *process.Process
+	tearingDown         chan struct{} // closed once the teardown underway (if any) is done
+	terminated          *process.Process
+	lingering           []*process.Process
+	stoppingLingering   []*process.Process
+	stopOutcome         process.StopOutcome
 	ctx                 context.Context
 	cancel              context.CancelFunc
 	logger              *slog.Logger
 	name                string
 }
 
+// Options describe how a managed process is run and (if need be) restarted
+type Options struct {
+	RestartPolicy       RestartPolicy
+	Shell               string
+	Command             string
+	Argv                []string // if set, run directly (exec form) rather than as Command via Shell
+	Env                 []string
+	InheritEnv          bool
+	Attributes          process.Attributes
+	RestartWaitDuration time.Duration
+	Backoff             Backoff
+	MaxRestarts         int // 0 means no limit
+	CrashLoop           CrashLoop
+	StopSignal          syscall.Signal
+	StopGracePeriod     time.Duration
+	RunTimeout          time.Duration // each run has its process group killed if it takes any longer; 0 means none
+}
+
 func New(
 	logs chan Log,
-	restartPolicy RestartPolicy,
-	shell string,
-	command string,
-	env []string,
-	inheritEnv bool,
-	restartWaitDuration time.Duration,
+	options Options,
 	onExit func(int),
 	name string,
 ) *ManagedProcess {
+	if options.StopSignal == 0 {
+		options.StopSignal = DefaultStopSignal
+	}
+
+	if options.StopGracePeriod <= 0 {
+		options.StopGracePeriod = DefaultStopGracePeriod
+	}
+
+	if options.CrashLoop.Exits == 0 {
+		options.CrashLoop.Exits = DefaultCrashLoopExits
+	}
+
+	if options.CrashLoop.Window <= 0 {
+		options.CrashLoop.Window = DefaultCrashLoopWindow
+	}
+
 	m := ManagedProcess{
 		logs:                logs,
-		restartPolicy:       restartPolicy,
-		shell:               shell,
-		command:             command,
-		env:                 env,
-		inheritEnv:          inheritEnv,
-		restartWaitDuration: restartWaitDuration,
+		restartPolicy:       options.RestartPolicy,
+		shell:               options.Shell,
+		command:             options.Command,
+		argv:                options.Argv,
+		env:                 options.Env,
+		inheritEnv:          options.InheritEnv,
+		attributes:          options.Attributes,
+		restartWaitDuration: options.RestartWaitDuration,
+		backoff:             options.Backoff,
+		maxRestarts:         options.MaxRestarts,
+		crashLoop:           options.CrashLoop,
+		stopSignal:          options.StopSignal,
+		stopGracePeriod:     options.StopGracePeriod,
+		runTimeout:          options.RunTimeout,
 		onExit:              onExit,
 		internalLogs:        make(chan Log, internalLogDepth),
 		mu:                  new(sync.Mutex),
@@ -85,110 +241,182 @@ func New(
 	return &m
 }
 
-func (m *ManagedProcess) runLogger() {
-
-	var l Log
-
+func (m *ManagedProcess) runLogger(ctx context.Context) {
 	for {
-		m.mu.Lock()
-		if !m.running {
-			m.mu.Unlock()
-			break
-		}
-		m.mu.Unlock()
-
 		select {
-		case l = <-m.internalLogs:
-			m.logs <- l
+		case <-ctx.Done():
+			return
+		case l := <-m.internalLogs:
+			// e.g. probes don't care for their output
+			if m.logs == nil {
+				m.pendingLogs.Add(-1)
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				m.pendingLogs.Add(-1)
+				return
+			case m.logs <- l:
+				m.pendingLogs.Add(-1)
+			}
 		}
 	}
 }
 
-func (m *ManagedProcess) runReader(name string, stream io.Reader) {
+func (m *ManagedProcess) emit(ctx context.Context, isStdout bool, isStderr bool, data []byte) bool {
+	l := Log{
+		Name:      m.name,
+		IsStdout:  isStdout,
+		IsStderr:  isStderr,
+		Timestamp: time.Now().UTC().UnixMilli(),
+		Seq:       m.seq.Add(1),
+		Data:      data,
+	}
+
+	m.pendingLogs.Add(1)
+
+	// nothing is dropped here; if whatever is downstream isn't keeping up (and has chosen to hold things up rather
+	// than drop anything) then so be it, the process will find itself blocked on its output
+	select {
+	case <-ctx.Done():
+		m.pendingLogs.Add(-1)
+		return false
+	case m.internalLogs <- l:
+	}
+
+	return true
+}
+
+// runReader reassembles the output into lines (each of which keeps its newline); a partial line is handed on as-is
+// once it reaches the max line length or once nothing more has turned up for a while
+func (m *ManagedProcess) runReader(ctx context.Context, name string, stream io.Reader, done func()) {
+	defer done()
+
 	isStdout := name == "stdout"
 	isStderr := name == "stderr"
 
-	for {
-		m.mu.Lock()
-		if !m.running {
-			m.mu.Unlock()
-			break
-		}
-		m.mu.Unlock()
+	chunks := make(chan []byte)
 
-		b := make([]byte, bufferSize)
+	go func() {
+		defer close(chunks)
 
-		n, err := stream.Read(b)
-		if err != nil {
-			if err != io.EOF {
+		for {
+			b := make([]byte, bufferSize)
+
+			// the pipes are only closed on stop, so any error here means we're done
+			n, err := stream.Read(b)
+			if n > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case chunks <- b[0:n]:
+				}
 			}
-			continue
-		}
 
-		if n == 0 {
-			continue
+			if err != nil {
+				return
+			}
 		}
+	}()
+
+	pending := make([]byte, 0)
 
-		buf := b[0:n]
+	idle := time.NewTimer(lineIdleTimeout)
+	idle.Stop()
+	defer idle.Stop()
 
-		l := Log{
-			Name:      m.name,
-			IsStdout:  isStdout,
-			IsStderr:  isStderr,
-			Timestamp: time.Now().UTC().UnixMilli(),
-			Data:      buf,
+	flush := func() bool {
+		if len(pending) == 0 {
+			return true
 		}
 
+		data := pending
+		pending = make([]byte, 0)
+
+		return m.emit(ctx, isStdout, isStderr, data)
+	}
+
+	for {
 		select {
-		case <-m.ctx.Done():
-			break
-		case m.internalLogs <- l:
-		default:
+		case <-ctx.Done():
+			return
+		case <-idle.C:
+			if !flush() {
+				return
+			}
+		case chunk, ok := <-chunks:
+			if !ok {
+				flush()
+				return
+			}
+
+			pending = append(pending, chunk...)
+
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 || i >= maxLineLength {
+					if len(pending) < maxLineLength {
+						break
+					}
+
+					i = maxLineLength - 1
+				}
+
+				data := make([]byte, i+1)
+				copy(data, pending[:i+1])
+				pending = pending[i+1:]
+
+				if !m.emit(ctx, isStdout, isStderr, data) {
+					return
+				}
+			}
+
+			idle.Stop()
+			if len(pending) > 0 {
+				idle.Reset(lineIdleTimeout)
+			}
 		}
 	}
-
-	_ = m.Stop()
 }
 
-func (m *ManagedProcess) runLifecycle() {
+func (m *ManagedProcess) runLifecycle(ctx context.Context) {
 	var p *process.Process
 	var returnCode int
+	var startedAt time.Time
 
-	restart := false
+	// restarts since the backoff was last reset, as opposed to m.restarts, which is since start
+	restarts := 0
 
 lifecycle:
 	for {
 		m.mu.Lock()
-		if !m.running {
-			m.mu.Unlock()
-			break
-		}
+		p = m.process
 		m.mu.Unlock()
 
-		m.mu.Lock()
-		if m.process == nil {
-			m.mu.Unlock()
+		if ctx.Err() != nil || p == nil {
 			break
 		}
-		p = m.process
-		m.mu.Unlock()
 
-		if restart {
-			m.mu.Lock()
-			m.process.Close()
-			m.process = process.Run(
-				m.shell,
-				m.command,
-				m.env,
-				m.inheritEnv,
-				m.stdoutWriter,
-				m.stderrWriter,
-			)
-			m.mu.Unlock()
-			restart = false
-		}
+		startedAt = time.Now()
 
-		_ = p.Wait()
+		timedOut := m.wait(p)
+
+		m.mu.Lock()
+		// a process being stopped is dealt with by Stop
+		if m.process == p {
+			m.addLingering(p)
+			m.recordExit()
+			m.endRun(p, m.terminated == p)
+			m.terminated = nil
+
+			// it was us that killed it, rather than the OOM killer
+			if timedOut {
+				m.history[len(m.history)-1].TimedOut = true
+				m.history[len(m.history)-1].OOMKilled = false
+			}
+		}
+		m.mu.Unlock()
 
 		returnCode = p.ReturnCode()
 
@@ -197,46 +425,171 @@ lifecycle:
 		switch m.restartPolicy {
 		case Never:
 			break lifecycle
-		case UnlessStopped:
-			time.Sleep(m.restartWaitDuration)
-			restart = true
-			continue lifecycle
+		case Always, UnlessStopped:
 		case OnFailure:
-			if returnCode != 0 {
-				time.Sleep(m.restartWaitDuration)
-				restart = true
-				continue lifecycle
+			if returnCode == 0 {
+				break lifecycle
 			}
+		}
+
+		if m.backoff.ResetWindow > 0 && time.Since(startedAt) >= m.backoff.ResetWindow {
+			restarts = 0
+		}
+
+		if m.maxRestarts > 0 && restarts >= m.maxRestarts {
+			m.logger.Error(fmt.Sprintf("giving up after %v restarts", restarts))
+
+			m.mu.Lock()
+			if ctx.Err() == nil {
+				m.failed = true
+			}
+			m.mu.Unlock()
+
+			break lifecycle
+		}
+
+		restartWaitDuration := m.backoff.wait(m.restartWaitDuration, restarts)
+
+		m.logger.Debug("restarting", "return_code", returnCode, "wait", restartWaitDuration)
+
+		select {
+		case <-ctx.Done():
 			break lifecycle
+		case <-time.After(restartWaitDuration):
 		}
+
+		m.mu.Lock()
+		// checked under the lock, as that's where stopping happens
+		if ctx.Err() != nil || !m.running {
+			m.mu.Unlock()
+			break
+		}
+		m.process = m.run()
+		m.startRun(m.process)
+		m.restarts++
+		m.mu.Unlock()
+
+		restarts++
 	}
 
-	_ = m.Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// only tidy up if we've not been stopped (and possibly started again) in the meantime
+	if ctx.Err() == nil {
+		_ = m.stop()
+	}
 }
 
-func (m *ManagedProcess) start() error {
-	m.stdoutReader, m.stdoutWriter = io.Pipe()
-	m.stderrReader, m.stderrWriter = io.Pipe()
+// wait waits for the given process to exit, killing its process group if it's still going after the run timeout (if
+// there is one); it reports whether it had to
+func (m *ManagedProcess) wait(p *process.Process) bool {
+	if m.runTimeout <= 0 {
+		_ = p.Wait()
+		return false
+	}
+
+	var timedOut atomic.Bool
+
+	timer := time.AfterFunc(m.runTimeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// a process being stopped is dealt with by Stop
+		if m.process != p {
+			return
+		}
+
+		timedOut.Store(true)
+
+		m.logger.Debug("timed out", "run_timeout", m.runTimeout)
+
+		p.Close()
+	})
 
-	m.process = process.Run(
+	_ = p.Wait()
+
+	timer.Stop()
+
+	return timedOut.Load()
+}
+
+// recentExits returns the number of exits within the crash loop window; it expects the lock to be held
+func (m *ManagedProcess) recentExits() int {
+	cutoff := time.Now().Add(-m.crashLoop.Window)
+
+	exitTimestamps := make([]time.Time, 0)
+	for _, exitTimestamp := range m.exitTimestamps {
+		if exitTimestamp.After(cutoff) {
+			exitTimestamps = append(exitTimestamps, exitTimestamp)
+		}
+	}
+
+	m.exitTimestamps = exitTimestamps
+
+	return len(exitTimestamps)
+}
+
+// recordExit notes an exit for the crash loop detection; it expects the lock to be held
+func (m *ManagedProcess) recordExit() {
+	if m.crashLoop.Exits < 0 {
+		return
+	}
+
+	wasCrashLooping := m.recentExits() >= m.crashLoop.Exits
+
+	m.exitTimestamps = append(m.exitTimestamps, time.Now())
+
+	if !wasCrashLooping && len(m.exitTimestamps) >= m.crashLoop.Exits {
+		m.logger.Warn(fmt.Sprintf("crash looping (%v exits within %v)", len(m.exitTimestamps), m.crashLoop.Window))
+	}
+}
+
+// run runs the argv directly if there is one (exec form), otherwise the command with the shell
+func (m *ManagedProcess) run() *process.Process {
+	if len(m.argv) > 0 {
+		return process.RunArgv(
+			m.argv,
+			m.env,
+			m.inheritEnv,
+			m.attributes,
+			m.stdoutWriter,
+			m.stderrWriter,
+		)
+	}
+
+	return process.Run(
 		m.shell,
 		m.command,
 		m.env,
 		m.inheritEnv,
+		m.attributes,
 		m.stdoutWriter,
 		m.stderrWriter,
 	)
+}
 
-	go m.runLogger()
+func (m *ManagedProcess) start() error {
+	m.stdoutReader, m.stdoutWriter = io.Pipe()
+	m.stderrReader, m.stderrWriter = io.Pipe()
+
+	m.process = m.run()
+	m.startRun(m.process)
+
+	go m.runLogger(m.ctx)
 	runtime.Gosched()
 
-	go m.runReader("stdout", m.stdoutReader)
+	readers := new(sync.WaitGroup)
+	readers.Add(2)
+	m.readers = readers
+
+	go m.runReader(m.ctx, "stdout", m.stdoutReader, readers.Done)
 	runtime.Gosched()
 
-	go m.runReader("stderr", m.stderrReader)
+	go m.runReader(m.ctx, "stderr", m.stderrReader, readers.Done)
 	runtime.Gosched()
 
-	go m.runLifecycle()
+	go m.runLifecycle(m.ctx)
 	runtime.Gosched()
 
 	return nil
@@ -246,57 +599,293 @@ func (m *ManagedProcess) Start() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// a teardown doesn't take long, so it's waited for rather than treated as still stopping
+	for m.tearingDown != nil {
+		tornDown := m.tearingDown
+		m.mu.Unlock()
+		<-tornDown
+		m.mu.Lock()
+	}
+
 	if m.running {
 		return fmt.Errorf("already running")
 	}
 
+	if m.stopping != nil {
+		return fmt.Errorf("still stopping")
+	}
+
 	m.running = true
+	m.failed = false
+	m.restarts = 0
+	m.exitTimestamps = nil
 	m.ctx, m.cancel = context.WithCancel(context.Background())
 
 	return m.start()
 }
 
+// flush waits (for a little while) for the logs that have already been read to be handed on
+func (m *ManagedProcess) flush() {
+	deadline := time.Now().Add(flushTimeout)
+
+	for m.pendingLogs.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(flushInterval)
+	}
+}
+
+// teardown cancels the context and closes the pipes; it expects the lock to be held, but lets go of it while waiting
+// for the logs to be handed on (so that the state of the process can still be asked after in the meantime), with Start
+// waiting for it to finish
+func (m *ManagedProcess) teardown() {
+	tornDown := make(chan struct{})
+	m.tearingDown = tornDown
+
+	stdoutReader, stdoutWriter := m.stdoutReader, m.stdoutWriter
+	stderrReader, stderrWriter := m.stderrReader, m.stderrWriter
+	readers := m.readers
+	cancel := m.cancel
+
+	m.readers = nil
+	m.cancel = nil
+
+	m.mu.Unlock()
+
+	// closing the write ends first lets the readers hand on whatever partial line they were holding on to
+	if stdoutWriter != nil {
+		_ = stdoutWriter.Close()
+	}
+
+	if stderrWriter != nil {
+		_ = stderrWriter.Close()
+	}
+
+	if readers != nil {
+		readersDone := make(chan struct{})
+		go func() {
+			readers.Wait()
+			close(readersDone)
+		}()
+
+		select {
+		case <-readersDone:
+		case <-time.After(flushTimeout):
+		}
+	}
+
+	m.flush()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	// anything that didn't make it out in time is dropped, rather than handed out after the next start
+drain:
+	for {
+		select {
+		case <-m.internalLogs:
+		default:
+			break drain
+		}
+	}
+	m.pendingLogs.Store(0)
+
+	if stdoutReader != nil {
+		_ = stdoutReader.Close()
+	}
+
+	if stderrReader != nil {
+		_ = stderrReader.Close()
+	}
+
+	m.mu.Lock()
+	m.tearingDown = nil
+	close(tornDown)
+}
+
 func (m *ManagedProcess) stop() error {
+	if !m.running {
+		return fmt.Errorf("not running")
+	}
+
 	m.running = false
+	m.process = nil
+
+	m.teardown()
+
+	return nil
+}
+
+// addLingering keeps track of an exited process if it has left anything behind in its process group (e.g. something
+// it started in the background), so that it can be dealt with on stop; it expects the lock to be held
+func (m *ManagedProcess) addLingering(p *process.Process) {
+	lingering := make([]*process.Process, 0)
+
+	for _, l := range m.lingering {
+		if l.Lingering() {
+			lingering = append(lingering, l)
+		}
+	}
+
+	if p.Lingering() {
+		lingering = append(lingering, p)
+	}
+
+	m.lingering = lingering
+}
+
+// stopLingering stops whatever the given processes have left behind, the same way as for a running process
+func (m *ManagedProcess) stopLingering(lingering []*process.Process) {
+	wg := new(sync.WaitGroup)
+
+	for _, l := range lingering {
+		l := l
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			stopOutcome := l.Stop(m.stopSignal, m.stopGracePeriod)
+			m.logger.Debug("stopped leftovers", "outcome", stopOutcome)
+
+			m.sweep(l)
+		}()
+	}
+
+	wg.Wait()
+
+	m.mu.Lock()
+	m.stoppingLingering = nil
+	m.mu.Unlock()
+}
+
+// sweep makes sure nothing is left in the process group of the given process
+func (m *ManagedProcess) sweep(p *process.Process) {
+	pids := p.Sweep()
+	if len(pids) > 0 {
+		m.logger.Warn(fmt.Sprintf("killed leftover processes %v", pids))
+	}
+}
+
+// Stop sends the stop signal to the process group, waits up to the stop grace period for it to exit and then kills it
+// if it hasn't; the pipes are left open in the meantime so that anything the process has to say on the way out is kept
+func (m *ManagedProcess) Stop() error {
+	m.mu.Lock()
+	lingering := m.lingering
+	m.lingering = nil
+	m.stoppingLingering = lingering
 
 	if !m.running {
+		m.mu.Unlock()
+
+		// the process may have exited by itself, but anything it left behind still needs stopping
+		m.stopLingering(lingering)
+
 		return fmt.Errorf("not running")
 	}
 
-	if m.process != nil {
-		m.process.Close()
-		m.process = nil
+	m.running = false
+	p := m.process
+	m.process = nil
+	m.stopping = p
+	m.mu.Unlock()
+
+	stopOutcome := process.AlreadyExited
+	if p != nil {
+		stopOutcome = p.Stop(m.stopSignal, m.stopGracePeriod)
+		m.sweep(p)
 	}
 
-	if m.cancel != nil {
-		m.cancel()
-		m.cancel = nil
+	m.stopLingering(lingering)
+
+	m.mu.Lock()
+	if p != nil {
+		// if it had already exited by the time it was asked to stop, then it wasn't us that stopped it
+		m.endRun(p, stopOutcome != process.AlreadyExited)
 	}
+	m.teardown()
+	m.stopping = nil
+	m.stopOutcome = stopOutcome
+	m.mu.Unlock()
+
+	if stopOutcome == process.Killed {
+		m.logger.Warn(fmt.Sprintf("killed after not exiting within %v of being sent %v", m.stopGracePeriod, m.stopSignal))
+	} else {
+		m.logger.Debug("stopped", "outcome", stopOutcome)
+	}
+
+	return nil
+}
+
+// Terminate stops the current run of the process (with the stop signal, and then SIGKILL after the grace period),
+// leaving it to the restart policy to decide what happens next, as if it had exited by itself; it doesn't wait
+func (m *ManagedProcess) Terminate() {
+	m.mu.Lock()
+	p := m.process
+	if p == nil || m.terminated == p {
+		m.mu.Unlock()
+		return
+	}
+
+	m.terminated = p
+	m.mu.Unlock()
+
+	m.logger.Debug("terminating")
+
+	go p.Stop(m.stopSignal, m.stopGracePeriod)
+}
+
+// StopOutcome reports how the process came to exit the last time it was stopped
+func (m *ManagedProcess) StopOutcome() process.StopOutcome {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if m.stdoutReader != nil {
-		_ = m.stdoutReader.Close()
+	return m.stopOutcome
+}
+
+// Kill forcefully kills the process, whether it's running or in the process of being stopped; it doesn't wait
+func (m *ManagedProcess) Kill() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping != nil {
+		m.stopping.Close()
 	}
 
-	if m.stderrWriter != nil {
-		_ = m.stderrWriter.Close()
+	if m.process != nil {
+		m.process.Close()
 	}
 
-	if m.stderrReader != nil {
-		_ = m.stderrReader.Close()
+	for _, l := range m.stoppingLingering {
+		l.Close()
 	}
+}
+
+// Failed reports whether the process has been given up on after hitting the restart limit
+func (m *ManagedProcess) Failed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if m.stderrWriter != nil {
-		_ = m.stderrWriter.Close()
+	return m.failed
+}
+
+// CrashLooping reports whether the process is still being restarted despite having exited too often too recently
+func (m *ManagedProcess) CrashLooping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.running || m.crashLoop.Exits < 0 {
+		return false
 	}
 
-	return nil
+	return m.recentExits() >= m.crashLoop.Exits
 }
 
-func (m *ManagedProcess) Stop() error {
+// Restarts returns the number of times the process has been restarted since it was started
+func (m *ManagedProcess) Restarts() int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	return m.stop()
+	return m.restarts
 }
 
 func (m *ManagedProcess) Running() bool {
@@ -3,9 +3,14 @@ package managed_process
 import (
 	"context"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/initialed85/dspo/pkg/process"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -48,12 +53,13 @@ func TestNew(t *testing.T) {
 	t.Run("RestartPolicyNeverZeroReturnCode", func(t *testing.T) {
 		m := New(
 			logs,
-			Never,
-			"/bin/bash",
-			"echo 'first'; sleep 0.1; echo 'second'",
-			nil,
-			true,
-			time.Second*1,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "echo 'first'; sleep 0.1; echo 'second'",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
 			onExit,
 			"managed_process_test",
 		)
@@ -75,12 +81,13 @@ func TestNew(t *testing.T) {
 	t.Run("RestartPolicyUnlessStoppedZeroReturnCode", func(t *testing.T) {
 		m := New(
 			logs,
-			UnlessStopped,
-			"/bin/bash",
-			"echo 'first'; sleep 0.1; echo 'second'",
-			nil,
-			true,
-			time.Second*1,
+			Options{
+				RestartPolicy:       UnlessStopped,
+				Shell:               "/bin/bash",
+				Command:             "echo 'first'; sleep 0.1; echo 'second'",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
 			onExit,
 			"managed_process_test",
 		)
@@ -102,12 +109,13 @@ func TestNew(t *testing.T) {
 	t.Run("RestartPolicyOnFailureZeroReturnCode", func(t *testing.T) {
 		m := New(
 			logs,
-			OnFailure,
-			"/bin/bash",
-			"echo 'first'; sleep 0.1; echo 'second'",
-			nil,
-			true,
-			time.Second*1,
+			Options{
+				RestartPolicy:       OnFailure,
+				Shell:               "/bin/bash",
+				Command:             "echo 'first'; sleep 0.1; echo 'second'",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
 			onExit,
 			"managed_process_test",
 		)
@@ -129,12 +137,226 @@ func TestNew(t *testing.T) {
 	t.Run("RestartPolicyOnFailureNonZeroReturnCode", func(t *testing.T) {
 		m := New(
 			logs,
-			OnFailure,
-			"/bin/bash",
-			"echo 'first'; sleep 0.1; echo 'second'; exit 1",
-			nil,
-			true,
-			time.Second*1,
+			Options{
+				RestartPolicy:       OnFailure,
+				Shell:               "/bin/bash",
+				Command:             "echo 'first'; sleep 0.1; echo 'second'; exit 1",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			_ = m.Stop()
+			datas = make([]string, 0)
+		}()
+
+		time.Sleep(time.Second * 2)
+
+		assert.Equal(
+			t,
+			[]string{"first\n", "second\n", "first\n", "second\n"},
+			datas,
+		)
+	})
+
+	t.Run("StopGraceful", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "trap 'echo bye; exit 0' TERM; echo 'hi'; while true; do sleep 0.1; done",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+				StopSignal:          syscall.SIGTERM,
+				StopGracePeriod:     time.Second * 5,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			datas = make([]string, 0)
+		}()
+
+		time.Sleep(time.Millisecond * 500)
+
+		before := time.Now()
+		require.NoError(t, m.Stop())
+		assert.Less(t, time.Since(before), time.Second*5)
+
+		assert.Equal(t, process.ExitedOnSignal, m.StopOutcome())
+		// the sleep gets the signal too, so bash may have something to say about it before the trap runs
+		require.NotEmpty(t, datas)
+		assert.Equal(t, "hi\n", datas[0])
+		assert.Contains(t, datas, "bye\n")
+	})
+
+	t.Run("StopKilledAfterGracePeriod", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "trap '' TERM; echo 'hi'; while true; do sleep 0.1; done",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+				StopSignal:          syscall.SIGTERM,
+				StopGracePeriod:     time.Millisecond * 500,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			datas = make([]string, 0)
+		}()
+
+		time.Sleep(time.Millisecond * 500)
+
+		before := time.Now()
+		require.NoError(t, m.Stop())
+		assert.GreaterOrEqual(t, time.Since(before), time.Millisecond*500)
+
+		assert.Equal(t, process.Killed, m.StopOutcome())
+		assert.False(t, m.Running())
+	})
+
+	t.Run("StopLeftovers", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "sleep 100 >/dev/null 2>&1 & echo $!",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+				StopGracePeriod:     time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			datas = make([]string, 0)
+		}()
+
+		require.NoError(t, waitUntilNotRunning(m, time.Second*1))
+		time.Sleep(time.Millisecond * 100)
+
+		require.Len(t, datas, 1)
+		pid, err := strconv.Atoi(strings.TrimSpace(datas[0]))
+		require.NoError(t, err)
+		require.NoError(t, syscall.Kill(pid, 0))
+
+		// the process itself is long gone, but what it left behind should still be stopped
+		require.Error(t, m.Stop())
+
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+		if err == nil {
+			require.Contains(t, string(b), ") Z ")
+		}
+	})
+
+	t.Run("ArgvForm", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Argv:                []string{"echo", "$HOME; not for a shell"},
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			_ = m.Stop()
+			datas = make([]string, 0)
+		}()
+
+		require.NoError(t, waitUntilNotRunning(m, time.Second*1))
+
+		assert.Equal(
+			t,
+			[]string{"$HOME; not for a shell\n"},
+			datas,
+		)
+	})
+
+	t.Run("MaxRestarts", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       UnlessStopped,
+				Shell:               "/bin/bash",
+				Command:             "echo 'crash'; exit 1",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+				Backoff:             Backoff{Multiplier: 2},
+				MaxRestarts:         2,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			_ = m.Stop()
+			datas = make([]string, 0)
+		}()
+
+		// waits of 50ms and then 100ms, then given up on
+		require.Eventually(t, m.Failed, time.Second*2, time.Millisecond*10)
+		assert.False(t, m.Running())
+		assert.Equal(t, 2, m.Restarts())
+		assert.Equal(t, []string{"crash\n", "crash\n", "crash\n"}, datas)
+
+		require.NoError(t, m.Start())
+		assert.False(t, m.Failed())
+		assert.Equal(t, 0, m.Restarts())
+	})
+
+	t.Run("CrashLooping", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       UnlessStopped,
+				Shell:               "/bin/bash",
+				Command:             "exit 1",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+				CrashLoop:           CrashLoop{Exits: 3, Window: time.Second * 2},
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			datas = make([]string, 0)
+		}()
+
+		assert.False(t, m.CrashLooping())
+		require.Eventually(t, m.CrashLooping, time.Second*2, time.Millisecond*10)
+		assert.True(t, m.Running())
+
+		_ = m.Stop()
+		assert.False(t, m.CrashLooping())
+	})
+
+	t.Run("RestartPolicyAlwaysZeroReturnCode", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Always,
+				Shell:               "/bin/bash",
+				Command:             "echo 'first'; sleep 0.1; echo 'second'",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
 			onExit,
 			"managed_process_test",
 		)
@@ -152,4 +374,355 @@ func TestNew(t *testing.T) {
 			datas,
 		)
 	})
+
+	t.Run("RestartPolicyOnFailureMaxRestarts", func(t *testing.T) {
+		restartPolicy, maxRestarts, err := ParseRestartPolicy("on-failure:2")
+		require.NoError(t, err)
+
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       restartPolicy,
+				Shell:               "/bin/bash",
+				Command:             "echo 'crash'; exit 1",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+				MaxRestarts:         maxRestarts,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			_ = m.Stop()
+			datas = make([]string, 0)
+		}()
+
+		require.Eventually(t, m.Failed, time.Second*2, time.Millisecond*10)
+		assert.Equal(t, []string{"crash\n", "crash\n", "crash\n"}, datas)
+	})
+
+	t.Run("History", func(t *testing.T) {
+		m := New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "exit 3",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*1))
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*1, time.Millisecond*10)
+
+		history := m.History()
+		require.Len(t, history, 1)
+		assert.True(t, history[0].Ended())
+		assert.Equal(t, 3, history[0].ExitCode)
+		assert.Equal(t, 0, history[0].Signal)
+		assert.False(t, history[0].Stopped)
+		assert.False(t, history[0].OOMKilled)
+
+		m = New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Argv:                []string{"sleep", "100"},
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.False(t, m.History()[0].Ended())
+		require.NoError(t, m.Stop())
+
+		history = m.History()
+		require.Len(t, history, 1)
+		assert.True(t, history[0].Ended())
+		assert.Equal(t, -1, history[0].ExitCode)
+		assert.Equal(t, int(syscall.SIGTERM), history[0].Signal)
+		assert.True(t, history[0].Stopped)
+		assert.False(t, history[0].OOMKilled)
+
+		m = New(
+			logs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "kill -9 $$",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*1))
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*1, time.Millisecond*10)
+
+		history = m.History()
+		require.Len(t, history, 1)
+		assert.Equal(t, int(syscall.SIGKILL), history[0].Signal)
+		assert.False(t, history[0].Stopped)
+		// the cgroup's OOM kill count didn't go up (if it's available at all)
+		assert.False(t, history[0].OOMKilled)
+
+		// without the cgroup's OOM kill count to go on, a SIGKILL from someone else isn't taken to be the OOM killer
+		originalCgroupRoot := cgroupRoot
+		cgroupRoot = t.TempDir()
+		defer func() {
+			cgroupRoot = originalCgroupRoot
+		}()
+		require.Equal(t, -1, getOOMKills())
+
+		m = New(
+			nil,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "kill -9 $$",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*1))
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*1, time.Millisecond*10)
+
+		history = m.History()
+		require.Len(t, history, 1)
+		assert.Equal(t, int(syscall.SIGKILL), history[0].Signal)
+		assert.False(t, history[0].Stopped)
+		assert.False(t, history[0].OOMKilled)
+	})
+
+	t.Run("ParseRestartPolicy", func(t *testing.T) {
+		for raw, expected := range map[string]RestartPolicy{
+			"":               Never,
+			"no":             Never,
+			"always":         Always,
+			"unless-stopped": UnlessStopped,
+			"on-failure":     OnFailure,
+			" on-failure:5 ": OnFailure,
+		} {
+			restartPolicy, _, err := ParseRestartPolicy(raw)
+			require.NoError(t, err, raw)
+			assert.Equal(t, expected, restartPolicy, raw)
+		}
+
+		_, maxRestarts, err := ParseRestartPolicy("on-failure:5")
+		require.NoError(t, err)
+		assert.Equal(t, 5, maxRestarts)
+
+		for _, raw := range []string{"sometimes", "always:5", "on-failure:", "on-failure:0", "on-failure:x"} {
+			_, _, err := ParseRestartPolicy(raw)
+			assert.Error(t, err, raw)
+		}
+	})
+
+	t.Run("BackoffWait", func(t *testing.T) {
+		assert.Equal(t, time.Second, Backoff{}.wait(time.Second, 5))
+
+		b := Backoff{Multiplier: 2, Max: time.Second * 5}
+		assert.Equal(t, time.Second, b.wait(time.Second, 0))
+		assert.Equal(t, time.Second*2, b.wait(time.Second, 1))
+		assert.Equal(t, time.Second*4, b.wait(time.Second, 2))
+		assert.Equal(t, time.Second*5, b.wait(time.Second, 3))
+
+		b = Backoff{Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			wait := b.wait(time.Second, 0)
+			assert.GreaterOrEqual(t, wait, time.Millisecond*500)
+			assert.LessOrEqual(t, wait, time.Millisecond*1500)
+		}
+	})
+
+	t.Run("LineFraming", func(t *testing.T) {
+		lineLogs := make(chan Log, 1024)
+
+		m := New(
+			lineLogs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "printf 'a\\nb\\nc'; sleep 0.5; printf 'd\\n'; head -c 40000 /dev/zero | tr '\\0' x",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*2))
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*2, time.Millisecond*10)
+
+		received := make([]Log, 0)
+	collect:
+		for {
+			select {
+			case l := <-lineLogs:
+				received = append(received, l)
+			default:
+				break collect
+			}
+		}
+
+		require.Len(t, received, 7)
+
+		assert.Equal(t, "a\n", string(received[0].Data))
+		assert.Equal(t, "b\n", string(received[1].Data))
+		assert.Equal(t, "c", string(received[2].Data))
+		assert.Equal(t, "d\n", string(received[3].Data))
+		assert.Equal(t, strings.Repeat("x", maxLineLength), string(received[4].Data))
+		assert.Equal(t, strings.Repeat("x", maxLineLength), string(received[5].Data))
+		assert.Equal(t, strings.Repeat("x", 40000-(maxLineLength*2)), string(received[6].Data))
+
+		for i, l := range received {
+			assert.True(t, l.IsStdout)
+			assert.Equal(t, uint64(i+1), l.Seq)
+		}
+	})
+	t.Run("RunTimeout", func(t *testing.T) {
+		m := New(
+			nil,
+			Options{
+				RestartPolicy: Never,
+				Shell:         "/bin/bash",
+				// the child shares the process group, so it goes as well
+				Command:             "sleep 10 & sleep 10",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+				RunTimeout:          time.Millisecond * 200,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		startedAt := time.Now()
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*2))
+		require.Less(t, time.Since(startedAt), time.Second*2)
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*2, time.Millisecond*10)
+
+		history := m.History()
+		require.Len(t, history, 1)
+		assert.True(t, history[0].TimedOut)
+		assert.False(t, history[0].OOMKilled)
+		assert.False(t, history[0].Stopped)
+		assert.Equal(t, int(syscall.SIGKILL), history[0].Signal)
+
+		// anything quicker than the timeout is unaffected
+		m = New(
+			nil,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "exit 3",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+				RunTimeout:          time.Millisecond * 200,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.NoError(t, waitUntilNotRunning(m, time.Second*2))
+		require.Eventually(t, func() bool { return !m.Running() }, time.Second*2, time.Millisecond*10)
+
+		history = m.History()
+		require.Len(t, history, 1)
+		assert.False(t, history[0].TimedOut)
+		assert.Equal(t, 3, history[0].ExitCode)
+	})
+	t.Run("Terminate", func(t *testing.T) {
+		m := New(
+			nil,
+			Options{
+				RestartPolicy:       Always,
+				Shell:               "/bin/bash",
+				Command:             "sleep 10",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+				StopGracePeriod:     time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		defer func() {
+			_ = m.Stop()
+		}()
+		require.Eventually(t, m.Running, time.Second*2, time.Millisecond*10)
+
+		// the restart policy brings it back, as if it had exited by itself
+		m.Terminate()
+		m.Terminate()
+		require.Eventually(t, func() bool { return m.Restarts() == 1 }, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, m.Running, time.Second*2, time.Millisecond*10)
+
+		history := m.History()
+		require.GreaterOrEqual(t, len(history), 1)
+		assert.True(t, history[0].Stopped)
+		assert.Equal(t, int(syscall.SIGTERM), history[0].Signal)
+
+		require.NoError(t, m.Stop())
+	})
+	t.Run("StateDuringTeardown", func(t *testing.T) {
+		// nothing reads these, so stopping waits for them to be handed on for as long as it's willing to
+		unreadLogs := make(chan Log)
+
+		m := New(
+			unreadLogs,
+			Options{
+				RestartPolicy:       Never,
+				Shell:               "/bin/bash",
+				Command:             "echo 'hello'; sleep 10",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Second * 1,
+			},
+			onExit,
+			"managed_process_test",
+		)
+		require.NoError(t, m.Start())
+		require.Eventually(t, func() bool { return m.pendingLogs.Load() > 0 }, time.Second*2, time.Millisecond*10)
+
+		stopped := make(chan struct{})
+		go func() {
+			_ = m.Stop()
+			close(stopped)
+		}()
+
+		time.Sleep(time.Millisecond * 300)
+
+		// still stopping, but that doesn't hold up anyone wanting to know how things stand
+		select {
+		case <-stopped:
+			require.FailNow(t, "stopped sooner than expected")
+		default:
+		}
+
+		askedAt := time.Now()
+		_ = m.Running()
+		_ = m.Failed()
+		_ = m.CrashLooping()
+		require.Len(t, m.History(), 1)
+		require.Less(t, time.Since(askedAt), time.Millisecond*100)
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "timed out waiting for stop")
+		}
+
+		// and it can be started again straight away
+		require.NoError(t, m.Start())
+		require.NoError(t, m.Stop())
+	})
 }
@@ -0,0 +1,84 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+const (
+	historyDepth = 32
+)
+
+// Result describes a single attempt by the probe
+type Result struct {
+	At       time.Time `json:"at"`
+	OK       bool      `json:"ok"`
+	TimedOut bool      `json:"timed_out"`       // whether the attempt was given up on for taking too long
+	Error    string    `json:"error,omitempty"` // why the attempt failed (e.g. a non-zero exit code)
+}
+
+// getResult returns the result for an attempt that ended with the given error (if any)
+func getResult(err error) Result {
+	result := Result{
+		At: time.Now(),
+		OK: err == nil,
+	}
+
+	if err == nil {
+		return result
+	}
+
+	result.Error = err.Error()
+
+	var netErr net.Error
+	result.TimedOut = errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+
+	return result
+}
+
+// getExitResult returns the result for an attempt by a command probe, from the last run of the given process
+func (p *Probe) getExitResult(managedProcess *managed_process.ManagedProcess, returnCode int) Result {
+	result := Result{
+		At: time.Now(),
+		OK: returnCode == 0,
+	}
+
+	history := managedProcess.History()
+	if len(history) > 0 && history[len(history)-1].TimedOut {
+		result.OK = false
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %v", p.timeout)
+
+		return result
+	}
+
+	if !result.OK {
+		result.Error = fmt.Sprintf("exited with %v", returnCode)
+	}
+
+	return result
+}
+
+// addResult records the given result; it expects the lock to be held
+func (p *Probe) addResult(result Result) {
+	p.history = append(p.history, result)
+	if len(p.history) > historyDepth {
+		p.history = p.history[len(p.history)-historyDepth:]
+	}
+}
+
+// History returns the results of the most recent attempts (oldest first)
+func (p *Probe) History() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	history := make([]Result, len(p.history))
+	copy(history, p.history)
+
+	return history
+}
@@ -0,0 +1,123 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+)
+
+const (
+	defaultMinStatus = 200
+	defaultMaxStatus = 399
+	maxBodyLength    = 1024 * 64
+)
+
+// checkHTTP makes the given HTTP request, returning an error if it fails or the response isn't as expected
+func checkHTTP(ctx context.Context, client *http.Client, h common.HTTPProbeArgs) error {
+	method := h.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range h.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	minStatus, maxStatus := h.MinStatus, h.MaxStatus
+	if minStatus == 0 && maxStatus == 0 {
+		minStatus, maxStatus = defaultMinStatus, defaultMaxStatus
+	}
+
+	if resp.StatusCode < minStatus || resp.StatusCode > maxStatus {
+		return fmt.Errorf("status %v not within %v - %v", resp.StatusCode, minStatus, maxStatus)
+	}
+
+	if h.BodyContains == "" && h.BodyMatches == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyLength))
+	if err != nil {
+		return err
+	}
+
+	if h.BodyContains != "" && !strings.Contains(string(body), h.BodyContains) {
+		return fmt.Errorf("body doesn't contain %#+v", h.BodyContains)
+	}
+
+	if h.BodyMatches != nil && !h.BodyMatches.Match(body) {
+		return fmt.Errorf("body doesn't match %#+v", h.BodyMatches.String())
+	}
+
+	return nil
+}
+
+// NewHTTP returns a probe that makes the given HTTP request every probeInterval, with the same semantics as New
+func NewHTTP(
+	startupTolerance time.Duration,
+	initialDelay time.Duration,
+	probeInterval time.Duration,
+	successThreshold int,
+	failureThreshold int,
+	h common.HTTPProbeArgs,
+	onReady func(),
+	onNotReady func(),
+	name string,
+) *Probe {
+	p := newProbe(
+		startupTolerance,
+		initialDelay,
+		probeInterval,
+		successThreshold,
+		failureThreshold,
+		onReady,
+		onNotReady,
+		name,
+	)
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = p.probeInterval
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		// each attempt makes a connection of its own (as that's part of what's being probed), and not via any proxy
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+		// a redirect is a response like any other, so it's judged by its status
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	p.check = func(ctx context.Context) error {
+		return checkHTTP(ctx, client, h)
+	}
+
+	return p
+}
@@ -0,0 +1,113 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/managed_process"
+)
+
+// matchLog reports whether the given log is of interest to the given log probe (matched) and if so, whether it means
+// ready (ok) or not; a line that matches both regexes means not ready
+func matchLog(l managed_process.Log, args common.LogProbeArgs) (ok bool, matched bool) {
+	if (args.Stream == "stdout" && !l.IsStdout) || (args.Stream == "stderr" && !l.IsStderr) {
+		return false, false
+	}
+
+	if args.FailureMatches != nil && args.FailureMatches.Match(l.Data) {
+		return false, true
+	}
+
+	if args.Matches != nil && args.Matches.Match(l.Data) {
+		return true, true
+	}
+
+	return false, false
+}
+
+// runMatches matches the given logs until the given context is cancelled; the outcome of the last match is handled
+// straight away and then again every probeInterval (as if it were the result of an attempt), so that it's subject to the
+// same startup tolerance and thresholds as any other probe; nothing is handled until the initial delay has passed
+func (p *Probe) runMatches(ctx context.Context, logs chan managed_process.Log, startedAt time.Time) {
+	delayUntil := startedAt.Add(p.initialDelay)
+
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+
+	var last *Result
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case l, open := <-logs:
+			if !open {
+				return
+			}
+
+			ok, matched := p.match(l)
+			if !matched {
+				continue
+			}
+
+			var err error
+			if !ok {
+				err = fmt.Errorf("failure matched %#+v", strings.TrimSuffix(string(l.Data), "\n"))
+				p.logger.Debug("check failed", "error", err)
+			}
+
+			result := getResult(err)
+			last = &result
+
+			if time.Now().Before(delayUntil) {
+				continue
+			}
+
+			p.onResult(ctx, result)
+		case <-ticker.C:
+			if last == nil || time.Now().Before(delayUntil) {
+				continue
+			}
+
+			result := *last
+			result.At = time.Now()
+			p.onResult(ctx, result)
+		}
+	}
+}
+
+// NewLog returns a probe that watches the logs it gets from subscribe (called on Start), becoming ready once a line
+// matches and (optionally) not ready once a line matches the failure regex, with the same semantics as New
+func NewLog(
+	startupTolerance time.Duration,
+	initialDelay time.Duration,
+	probeInterval time.Duration,
+	successThreshold int,
+	failureThreshold int,
+	args common.LogProbeArgs,
+	subscribe func() (chan managed_process.Log, func(), error),
+	onReady func(),
+	onNotReady func(),
+	name string,
+) *Probe {
+	p := newProbe(
+		startupTolerance,
+		initialDelay,
+		probeInterval,
+		successThreshold,
+		failureThreshold,
+		onReady,
+		onNotReady,
+		name,
+	)
+
+	p.subscribe = subscribe
+	p.match = func(l managed_process.Log) (bool, bool) {
+		return matchLog(l, args)
+	}
+
+	return p
+}
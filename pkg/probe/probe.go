@@ -1,85 +1,282 @@
 package probe
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/initialed85/dspo/internal"
 	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
+)
+
+const (
+	DefaultProbeInterval = time.Second
 )
 
 type Probe struct {
-	startupTolerance  time.Duration
-	probeInterval     time.Duration
-	permittedFailures int
-	onReady           func()
-	onNotReady        func()
-	mu                sync.Mutex
-	managedProcess    *managed_process.ManagedProcess
-	ignoreUntil       time.Time
-	failureCount      int
-	ready             bool
-	logger            *slog.Logger
+	startupTolerance time.Duration
+	initialDelay     time.Duration
+	probeInterval    time.Duration
+	successThreshold int
+	failureThreshold int
+	timeout          time.Duration
+	onReady          func()
+	onNotReady       func()
+	mu               sync.Mutex
+	managedProcess   *managed_process.ManagedProcess
+	processStarted   bool
+	newProcess       func(onExit func(returnCode int)) *managed_process.ManagedProcess
+	check            func(ctx context.Context) error
+	subscribe        func() (chan managed_process.Log, func(), error)
+	match            func(l managed_process.Log) (ok bool, matched bool)
+	cancel           context.CancelFunc
+	ignoreUntil      time.Time
+	successCount     int
+	failureCount     int
+	ready            bool
+	callbacks        int        // callbacks underway, which may have been brought about by an attempt before Stop
+	callbacksIdle    *sync.Cond // signalled (on mu) when there are no callbacks underway
+	history          []Result
+	logger           *slog.Logger
 }
 
+// New returns a probe that runs the given command every probeInterval (once initialDelay has passed), becoming ready
+// after successThreshold successes in a row and not ready after failureThreshold failures in a row (both 1 if 0), with
+// anything in the startupTolerance ignored; a probeInterval that isn't positive means DefaultProbeInterval
 func New(
 	startupTolerance time.Duration,
+	initialDelay time.Duration,
 	probeInterval time.Duration,
-	permittedFailures int,
+	successThreshold int,
+	failureThreshold int,
 	command string,
+	argv []string,
 	env []string,
 	inheritEnv bool,
+	attributes process.Attributes,
+	timeout time.Duration,
 	onReady func(),
 	onNotReady func(),
 	name string,
 ) *Probe {
-	p := Probe{
-		startupTolerance:  startupTolerance,
-		probeInterval:     probeInterval,
-		permittedFailures: permittedFailures,
-		onReady:           onReady,
-		onNotReady:        onNotReady,
-		logger:            internal.GetLogger(name),
-	}
-
-	p.managedProcess = managed_process.New(
-		nil,
-		managed_process.UnlessStopped,
-		"/bin/bash",
-		command,
-		env,
-		inheritEnv,
+	p := newProbe(
+		startupTolerance,
+		initialDelay,
 		probeInterval,
-		p.onExit,
+		successThreshold,
+		failureThreshold,
+		onReady,
+		onNotReady,
 		name,
 	)
 
+	p.timeout = timeout
+
+	p.newProcess = func(onExit func(returnCode int)) *managed_process.ManagedProcess {
+		return managed_process.New(
+			nil,
+			managed_process.Options{
+				RestartPolicy:       managed_process.UnlessStopped,
+				Shell:               "/bin/bash",
+				Command:             command,
+				Argv:                argv,
+				Env:                 env,
+				InheritEnv:          inheritEnv,
+				Attributes:          attributes,
+				RestartWaitDuration: p.probeInterval,
+				// probes exit all the time by design
+				CrashLoop: managed_process.CrashLoop{Exits: -1},
+				// probes have nothing to clean up, so there's no point being gentle
+				StopSignal: syscall.SIGKILL,
+				// killed (and counted as a failure) if it takes any longer
+				RunTimeout: timeout,
+			},
+			onExit,
+			name,
+		)
+	}
+
+	return p
+}
+
+func newProbe(
+	startupTolerance time.Duration,
+	initialDelay time.Duration,
+	probeInterval time.Duration,
+	successThreshold int,
+	failureThreshold int,
+	onReady func(),
+	onNotReady func(),
+	name string,
+) *Probe {
+	if successThreshold <= 0 {
+		successThreshold = 1
+	}
+
+	if failureThreshold <= 0 {
+		failureThreshold = 1
+	}
+
+	// anything less would have a probe spinning (or, for those that time out after an interval, failing straight away)
+	if probeInterval <= 0 {
+		probeInterval = DefaultProbeInterval
+	}
+
+	p := Probe{
+		startupTolerance: startupTolerance,
+		initialDelay:     initialDelay,
+		probeInterval:    probeInterval,
+		successThreshold: successThreshold,
+		failureThreshold: failureThreshold,
+		onReady:          onReady,
+		onNotReady:       onNotReady,
+		logger:           internal.GetLogger(name),
+	}
+
+	p.callbacksIdle = sync.NewCond(&p.mu)
+
 	return &p
 }
 
-func (p *Probe) onExit(returnCode int) {
+// waitForInitialDelay waits until the initial delay has passed since the given time, reporting whether it did so
+// before the given context was cancelled
+func (p *Probe) waitForInitialDelay(ctx context.Context, startedAt time.Time) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Until(startedAt.Add(p.initialDelay))):
+		return true
+	}
+}
+
+// startProcessAfterInitialDelay starts a command probe's process once the initial delay has passed (unless the probe
+// has been stopped in the meantime)
+func (p *Probe) startProcessAfterInitialDelay(ctx context.Context, startedAt time.Time) {
+	if !p.waitForInitialDelay(ctx, startedAt) {
+		return
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if ctx.Err() != nil {
+		return
+	}
+
+	err := p.managedProcess.Start()
+	if err != nil {
+		p.logger.Error("failed to start", "error", err)
+		return
+	}
+
+	p.processStarted = true
+}
+
+// runChecks runs the probe's check every probeInterval (once the initial delay has passed) until the given context is
+// cancelled
+func (p *Probe) runChecks(ctx context.Context, startedAt time.Time) {
+	if !p.waitForInitialDelay(ctx, startedAt) {
+		return
+	}
+
+	for {
+		err := p.check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			p.logger.Debug("check failed", "error", err)
+		}
+
+		p.onResult(ctx, getResult(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.probeInterval):
+		}
+	}
+}
+
+// onResult handles the result of an attempt made under the given context; a result that comes in after that context is
+// cancelled (i.e. once the probe has been stopped) is of no interest
+func (p *Probe) onResult(ctx context.Context, result Result) {
+	p.mu.Lock()
+
+	if ctx.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+
+	p.addResult(result)
+
 	if time.Now().Before(p.ignoreUntil) {
+		p.mu.Unlock()
 		return
 	}
 
-	if returnCode != 0 {
+	// the callbacks are invoked without the lock held, as they may (via the owning service) end up stopping this probe
+	if !result.OK {
+		p.successCount = 0
 		p.failureCount++
 
-		if p.failureCount > p.permittedFailures {
-			p.onNotReady()
+		if p.failureCount >= p.failureThreshold {
 			p.ready = false
+			p.callbacks++
+			p.mu.Unlock()
+
+			p.onNotReady()
+			p.doneCallback()
+
+			return
 		}
 
+		p.mu.Unlock()
+
 		return
 	}
 
-	p.onReady()
-	p.ready = true
 	p.failureCount = 0
+	p.successCount++
+
+	if p.successCount < p.successThreshold {
+		p.mu.Unlock()
+
+		return
+	}
+
+	p.ready = true
+	p.callbacks++
+	p.mu.Unlock()
+
+	p.onReady()
+	p.doneCallback()
+}
+
+func (p *Probe) doneCallback() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.callbacks--
+	if p.callbacks == 0 {
+		p.callbacksIdle.Broadcast()
+	}
+}
+
+// WaitForCallbacks waits for any callbacks that are underway (e.g. for an attempt made before the probe was stopped) to
+// return; it mustn't be called from the callbacks themselves
+func (p *Probe) WaitForCallbacks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.callbacks > 0 {
+		p.callbacksIdle.Wait()
+	}
 }
 
 func (p *Probe) SetIgnoreUntil(ignoreUntil time.Time) {
@@ -93,12 +290,57 @@ func (p *Probe) Start() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	err := p.managedProcess.Start()
-	if err != nil {
-		return err
+	if p.cancel != nil {
+		return fmt.Errorf("already started")
+	}
+
+	startedAt := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if p.newProcess != nil {
+		// a process of its own for each start, so that the exit of one that was running when the probe was stopped is
+		// handled under the context it was started with (and so ignored)
+		var managedProcess *managed_process.ManagedProcess
+		managedProcess = p.newProcess(func(returnCode int) {
+			p.onResult(ctx, p.getExitResult(managedProcess, returnCode))
+		})
+		p.managedProcess = managedProcess
+
+		if p.initialDelay <= 0 {
+			err := p.managedProcess.Start()
+			if err != nil {
+				cancel()
+				return err
+			}
+
+			p.processStarted = true
+		} else {
+			go p.startProcessAfterInitialDelay(ctx, startedAt)
+		}
+
+		p.cancel = cancel
+	} else if p.subscribe != nil {
+		logs, unsubscribe, err := p.subscribe()
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		p.cancel = func() {
+			cancel()
+			unsubscribe()
+		}
+
+		go p.runMatches(ctx, logs, startedAt)
+	} else {
+		p.cancel = cancel
+
+		go p.runChecks(ctx, startedAt)
 	}
 
-	p.ignoreUntil = time.Now().Add(p.startupTolerance)
+	p.ignoreUntil = startedAt.Add(p.startupTolerance)
+	p.successCount = 0
 	p.failureCount = 0
 
 	p.logger.Debug("started")
@@ -110,9 +352,22 @@ func (p *Probe) Stop() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	err := p.managedProcess.Stop()
-	if err != nil {
-		return err
+	if p.cancel == nil {
+		return fmt.Errorf("not started")
+	}
+
+	// not waited on, as this may be called (via the owning service) from the callbacks that runChecks / runMatches
+	// invoke
+	p.cancel()
+	p.cancel = nil
+
+	if p.processStarted {
+		p.processStarted = false
+
+		err := p.managedProcess.Stop()
+		if err != nil {
+			return err
+		}
 	}
 
 	p.logger.Debug("stopped")
@@ -1,10 +1,22 @@
 package probe
 
 import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
 	"github.com/initialed85/dspo/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -16,11 +28,16 @@ func TestNew(t *testing.T) {
 	t.Run("TransitionFromNotReadyToReadyToNotReady", func(t *testing.T) {
 		p := New(
 			time.Millisecond*300,
+			0,
 			time.Millisecond*100,
-			3,
+			1,
+			4,
 			probeHarness.GetExecutablePath(),
 			nil,
+			nil,
 			true,
+			process.Attributes{},
+			0,
 			func() {
 				ready = true
 			},
@@ -60,4 +77,508 @@ func TestNew(t *testing.T) {
 			time.Millisecond*100,
 		)
 	})
+	t.Run("HTTP", func(t *testing.T) {
+		var status atomic.Int64
+		status.Store(http.StatusServiceUnavailable)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("X-Probe") != "yes" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(int(status.Load()))
+			_, _ = w.Write([]byte("status: ok"))
+		}))
+		defer server.Close()
+
+		var httpReady atomic.Bool
+
+		p := NewHTTP(
+			time.Millisecond*300,
+			0,
+			time.Millisecond*100,
+			1,
+			4,
+			common.HTTPProbeArgs{
+				URL:          server.URL,
+				Method:       http.MethodPost,
+				Headers:      map[string]string{"X-Probe": "yes"},
+				MinStatus:    200,
+				MaxStatus:    299,
+				BodyContains: "ok",
+				BodyMatches:  regexp.MustCompile("^status: "),
+			},
+			func() {
+				httpReady.Store(true)
+			},
+			func() {
+				httpReady.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, p.Start())
+		defer func() {
+			_ = p.Stop()
+		}()
+
+		time.Sleep(time.Millisecond * 500)
+		require.False(t, httpReady.Load())
+
+		status.Store(http.StatusAccepted)
+		require.Eventually(t, httpReady.Load, time.Second*5, time.Millisecond*10)
+
+		status.Store(http.StatusInternalServerError)
+		require.Eventually(t, func() bool { return !httpReady.Load() }, time.Second*5, time.Millisecond*10)
+
+		status.Store(http.StatusOK)
+		require.Eventually(t, httpReady.Load, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, p.Stop())
+		require.Error(t, p.Stop())
+
+		// nothing changes once stopped
+		status.Store(http.StatusInternalServerError)
+		time.Sleep(time.Millisecond * 500)
+		require.True(t, httpReady.Load())
+	})
+
+	t.Run("HTTPChecks", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow":
+				time.Sleep(time.Millisecond * 200)
+			case "/redirect":
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			_, _ = w.Write([]byte("hello"))
+		}))
+		defer server.Close()
+
+		client := &http.Client{Timeout: time.Millisecond * 100}
+		ctx := context.Background()
+
+		require.NoError(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL}))
+		require.NoError(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL, BodyContains: "ell"}))
+		require.Error(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL, BodyContains: "nope"}))
+		require.Error(
+			t,
+			checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL, BodyMatches: regexp.MustCompile("^ell")}),
+		)
+		require.Error(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL, MinStatus: 201, MaxStatus: 299}))
+		require.Error(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: server.URL + "/slow"}))
+		require.Error(t, checkHTTP(ctx, client, common.HTTPProbeArgs{URL: "http://127.0.0.1:1"}))
+	})
+	t.Run("Socket", func(t *testing.T) {
+		address := filepath.Join(t.TempDir(), "test.sock")
+
+		var socketReady atomic.Bool
+
+		p := NewSocket(
+			time.Millisecond*300,
+			0,
+			time.Millisecond*100,
+			1,
+			4,
+			common.SocketProbeArgs{
+				Network: "unix",
+				Address: address,
+			},
+			func() {
+				socketReady.Store(true)
+			},
+			func() {
+				socketReady.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, p.Start())
+		defer func() {
+			_ = p.Stop()
+		}()
+
+		time.Sleep(time.Millisecond * 500)
+		require.False(t, socketReady.Load())
+
+		listener, err := net.Listen("unix", address)
+		require.NoError(t, err)
+		require.Eventually(t, socketReady.Load, time.Second*5, time.Millisecond*10)
+
+		_ = listener.Close()
+		require.Eventually(t, func() bool { return !socketReady.Load() }, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("SocketChecks", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() {
+			_ = listener.Close()
+		}()
+
+		// a banner, and then an echo of whatever's sent
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					defer func() {
+						_ = conn.Close()
+					}()
+
+					_, _ = conn.Write([]byte("+OK ready\r\n"))
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		address := listener.Addr().String()
+		ctx := context.Background()
+		timeout := time.Millisecond * 200
+
+		check := func(ctx context.Context, send string, expect string) error {
+			return checkSocket(
+				ctx,
+				timeout,
+				common.SocketProbeArgs{Network: "tcp", Address: address, Send: send, Expect: expect},
+			)
+		}
+
+		require.NoError(t, check(ctx, "", ""))
+		require.NoError(t, check(ctx, "", "+OK"))
+		require.NoError(t, check(ctx, "PING\r\n", "PING"))
+		require.Error(t, check(ctx, "", "-ERR"))
+		require.Error(t, checkSocket(ctx, timeout, common.SocketProbeArgs{Network: "tcp", Address: "127.0.0.1:1"}))
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Error(t, check(cancelledCtx, "", ""))
+	})
+	t.Run("Log", func(t *testing.T) {
+		logs := make(chan managed_process.Log, 16)
+		unsubscribed := make(chan struct{})
+
+		var logReady atomic.Bool
+
+		p := NewLog(
+			0,
+			0,
+			time.Millisecond*50,
+			1,
+			3,
+			common.LogProbeArgs{
+				Stream:         "stderr",
+				Matches:        regexp.MustCompile("compiled successfully"),
+				FailureMatches: regexp.MustCompile("(?i)error"),
+			},
+			func() (chan managed_process.Log, func(), error) {
+				return logs, func() { close(unsubscribed) }, nil
+			},
+			func() {
+				logReady.Store(true)
+			},
+			func() {
+				logReady.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, p.Start())
+		defer func() {
+			_ = p.Stop()
+		}()
+
+		logs <- managed_process.Log{IsStdout: true, Data: []byte("compiled successfully\n")}
+		logs <- managed_process.Log{IsStderr: true, Data: []byte("compiling...\n")}
+		time.Sleep(time.Millisecond * 200)
+		require.False(t, logReady.Load())
+
+		logs <- managed_process.Log{IsStderr: true, Data: []byte("compiled successfully\n")}
+		require.Eventually(t, logReady.Load, time.Second*5, time.Millisecond*10)
+
+		logs <- managed_process.Log{IsStderr: true, Data: []byte("Error: out of cheese\n")}
+		require.Eventually(t, func() bool { return !logReady.Load() }, time.Second*5, time.Millisecond*10)
+
+		logs <- managed_process.Log{IsStderr: true, Data: []byte("compiled successfully\n")}
+		require.Eventually(t, logReady.Load, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, p.Stop())
+		<-unsubscribed
+	})
+
+	t.Run("MatchLog", func(t *testing.T) {
+		args := common.LogProbeArgs{
+			Matches:        regexp.MustCompile("ready"),
+			FailureMatches: regexp.MustCompile("not ready"),
+		}
+
+		for _, c := range []struct {
+			l       managed_process.Log
+			stream  string
+			ok      bool
+			matched bool
+		}{
+			{managed_process.Log{IsStdout: true, Data: []byte("ready\n")}, "", true, true},
+			{managed_process.Log{IsStderr: true, Data: []byte("ready\n")}, "", true, true},
+			{managed_process.Log{IsStderr: true, Data: []byte("ready\n")}, "stdout", false, false},
+			{managed_process.Log{IsStdout: true, Data: []byte("not ready\n")}, "stdout", false, true},
+			{managed_process.Log{IsStdout: true, Data: []byte("steady\n")}, "", false, false},
+		} {
+			args.Stream = c.stream
+
+			ok, matched := matchLog(c.l, args)
+			require.Equal(t, c.ok, ok, string(c.l.Data))
+			require.Equal(t, c.matched, matched, string(c.l.Data))
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		var timeoutReady atomic.Bool
+		timeoutReady.Store(true)
+
+		p := New(
+			0,
+			0,
+			time.Millisecond*50,
+			1,
+			1,
+			"sleep 10",
+			nil,
+			nil,
+			true,
+			process.Attributes{},
+			time.Millisecond*100,
+			func() {
+				timeoutReady.Store(true)
+			},
+			func() {
+				timeoutReady.Store(false)
+			},
+			"test",
+		)
+		startedAt := time.Now()
+		require.NoError(t, p.Start())
+		defer func() {
+			_ = p.Stop()
+		}()
+
+		require.Eventually(t, func() bool { return !timeoutReady.Load() }, time.Second*5, time.Millisecond*10)
+		require.Less(t, time.Since(startedAt), time.Second*5)
+
+		history := p.History()
+		require.NotEmpty(t, history)
+		assert.False(t, history[0].OK)
+		assert.True(t, history[0].TimedOut)
+		assert.Equal(t, "timed out after 100ms", history[0].Error)
+
+		require.NoError(t, p.Stop())
+
+		// a non-zero exit is a failure of a different kind
+		p = New(
+			0,
+			0,
+			time.Millisecond*50,
+			1,
+			1,
+			"exit 3",
+			nil,
+			nil,
+			true,
+			process.Attributes{},
+			time.Millisecond*100,
+			common.NoOpFunc,
+			common.NoOpFunc,
+			"test",
+		)
+		require.NoError(t, p.Start())
+
+		require.Eventually(t, func() bool { return len(p.History()) > 0 }, time.Second*5, time.Millisecond*10)
+		require.NoError(t, p.Stop())
+
+		history = p.History()
+		assert.False(t, history[0].OK)
+		assert.False(t, history[0].TimedOut)
+		assert.Equal(t, "exited with 3", history[0].Error)
+	})
+
+	t.Run("CheckTimeout", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond * 200)
+		}))
+		defer server.Close()
+
+		client := &http.Client{Timeout: time.Millisecond * 50}
+
+		result := getResult(checkHTTP(context.Background(), client, common.HTTPProbeArgs{URL: server.URL}))
+		assert.False(t, result.OK)
+		assert.True(t, result.TimedOut)
+
+		result = getResult(checkHTTP(context.Background(), client, common.HTTPProbeArgs{URL: "http://127.0.0.1:1"}))
+		assert.False(t, result.OK)
+		assert.False(t, result.TimedOut)
+	})
+	t.Run("ThresholdsAndInitialDelay", func(t *testing.T) {
+		var requests atomic.Int64
+		var healthy atomic.Bool
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		var thresholdReady atomic.Bool
+		var readyCount, notReadyCount atomic.Int64
+
+		healthy.Store(true)
+
+		p := NewHTTP(
+			0,
+			time.Millisecond*300,
+			time.Millisecond*50,
+			3,
+			2,
+			common.HTTPProbeArgs{URL: server.URL},
+			func() {
+				thresholdReady.Store(true)
+				readyCount.Add(1)
+			},
+			func() {
+				thresholdReady.Store(false)
+				notReadyCount.Add(1)
+			},
+			"test",
+		)
+		require.NoError(t, p.Start())
+		defer func() {
+			_ = p.Stop()
+		}()
+
+		// nothing is attempted until the initial delay has passed
+		time.Sleep(time.Millisecond * 200)
+		assert.Equal(t, int64(0), requests.Load())
+		assert.Empty(t, p.History())
+
+		// it takes 3 successes in a row to be ready
+		require.Eventually(t, thresholdReady.Load, time.Second*5, time.Millisecond*10)
+		assert.GreaterOrEqual(t, len(p.History()), 3)
+
+		// and 2 failures in a row to be not ready
+		healthy.Store(false)
+		require.Eventually(t, func() bool { return !thresholdReady.Load() }, time.Second*5, time.Millisecond*10)
+
+		history := p.History()
+		require.GreaterOrEqual(t, len(history), 2)
+		assert.False(t, history[len(history)-1].OK)
+		assert.False(t, history[len(history)-2].OK)
+
+		healthy.Store(true)
+		require.Eventually(t, thresholdReady.Load, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, p.Stop())
+
+		assert.Equal(t, int64(2), readyCount.Load())
+		assert.Equal(t, int64(1), notReadyCount.Load())
+	})
+	t.Run("StopMidAttempt", func(t *testing.T) {
+		var callbacks atomic.Int64
+
+		p := New(
+			0,
+			0,
+			time.Millisecond*50,
+			1,
+			1,
+			"sleep 10",
+			nil,
+			nil,
+			true,
+			process.Attributes{},
+			time.Second*5,
+			func() {
+				callbacks.Add(1)
+			},
+			func() {
+				callbacks.Add(1)
+			},
+			"test",
+		)
+		require.NoError(t, p.Start())
+
+		// the attempt is killed by stopping, which isn't a failure of the attempt
+		time.Sleep(time.Millisecond * 200)
+		require.NoError(t, p.Stop())
+
+		time.Sleep(time.Millisecond * 200)
+		assert.Empty(t, p.History())
+		assert.Equal(t, int64(0), callbacks.Load())
+
+		// the same goes for a restart, with nothing from before the stop turning up afterwards
+		require.NoError(t, p.Start())
+		time.Sleep(time.Millisecond * 200)
+		require.NoError(t, p.Stop())
+
+		time.Sleep(time.Millisecond * 200)
+		assert.Empty(t, p.History())
+		assert.Equal(t, int64(0), callbacks.Load())
+	})
+
+	t.Run("NonPositiveInterval", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		for _, probeInterval := range []time.Duration{0, -time.Second} {
+			logs := make(chan managed_process.Log, 1)
+
+			var logReady atomic.Bool
+			var httpReady atomic.Bool
+
+			logProbe := NewLog(
+				0,
+				0,
+				probeInterval,
+				1,
+				1,
+				common.LogProbeArgs{Matches: regexp.MustCompile("ready")},
+				func() (chan managed_process.Log, func(), error) {
+					return logs, func() {}, nil
+				},
+				func() {
+					logReady.Store(true)
+				},
+				func() {},
+				"test",
+			)
+			require.NoError(t, logProbe.Start())
+
+			// the interval is also the timeout for each attempt, so one that isn't positive would fail every time
+			httpProbe := NewHTTP(
+				0,
+				0,
+				probeInterval,
+				1,
+				1,
+				common.HTTPProbeArgs{URL: server.URL},
+				func() {
+					httpReady.Store(true)
+				},
+				func() {},
+				"test",
+			)
+			require.NoError(t, httpProbe.Start())
+
+			logs <- managed_process.Log{Data: []byte("ready\n")}
+
+			require.Eventually(t, logReady.Load, time.Second*5, time.Millisecond*10)
+			require.Eventually(t, httpReady.Load, time.Second*5, time.Millisecond*10)
+
+			require.NoError(t, logProbe.Stop())
+			require.NoError(t, httpProbe.Stop())
+		}
+	})
 }
@@ -0,0 +1,110 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/common"
+)
+
+const (
+	maxExpectLength = 1024 * 64
+)
+
+// checkSocket connects to the given socket (optionally sending something and expecting something back), returning an
+// error if it can't or doesn't get what it expects within the given timeout
+func checkSocket(ctx context.Context, timeout time.Duration, s common.SocketProbeArgs) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if s.Send == "" && s.Expect == "" {
+		return nil
+	}
+
+	// the deadline covers a peer that's slow to talk, closing covers the probe being stopped
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if s.Send != "" {
+		_, err = conn.Write([]byte(s.Send))
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Expect == "" {
+		return nil
+	}
+
+	received := make([]byte, 0)
+	buf := make([]byte, 4096)
+
+	for len(received) < maxExpectLength {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+
+		if bytes.Contains(received, []byte(s.Expect)) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("didn't receive %#+v before %w", s.Expect, err)
+		}
+	}
+
+	return fmt.Errorf("didn't receive %#+v in the first %v bytes", s.Expect, maxExpectLength)
+}
+
+// NewSocket returns a probe that connects to the given TCP or unix socket every probeInterval, with the same semantics
+// as New
+func NewSocket(
+	startupTolerance time.Duration,
+	initialDelay time.Duration,
+	probeInterval time.Duration,
+	successThreshold int,
+	failureThreshold int,
+	s common.SocketProbeArgs,
+	onReady func(),
+	onNotReady func(),
+	name string,
+) *Probe {
+	p := newProbe(
+		startupTolerance,
+		initialDelay,
+		probeInterval,
+		successThreshold,
+		failureThreshold,
+		onReady,
+		onNotReady,
+		name,
+	)
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = p.probeInterval
+	}
+
+	p.check = func(ctx context.Context) error {
+		return checkSocket(ctx, timeout, s)
+	}
+
+	return p
+}
@@ -0,0 +1,143 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Attributes describe how a process is run beyond its command and environment; the zero value means the same as dspo
+type Attributes struct {
+	WorkingDir string
+	User       string       // name or id; the primary group of the user is used unless Group is set
+	Group      string       // name or id
+	Umask      *os.FileMode // nil means inherit
+}
+
+func lookupUser(raw string) (*user.User, error) {
+	_, err := strconv.Atoi(raw)
+	if err == nil {
+		u, err := user.LookupId(raw)
+		if err != nil {
+			return nil, fmt.Errorf("unknown user id %v", raw)
+		}
+
+		return u, nil
+	}
+
+	u, err := user.Lookup(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %#+v", raw)
+	}
+
+	return u, nil
+}
+
+func lookupGroup(raw string) (*user.Group, error) {
+	_, err := strconv.Atoi(raw)
+	if err == nil {
+		g, err := user.LookupGroupId(raw)
+		if err != nil {
+			return nil, fmt.Errorf("unknown group id %v", raw)
+		}
+
+		return g, nil
+	}
+
+	g, err := user.LookupGroup(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unknown group %#+v", raw)
+	}
+
+	return g, nil
+}
+
+func parseID(raw string) uint32 {
+	id, _ := strconv.ParseUint(raw, 10, 32)
+
+	return uint32(id)
+}
+
+// credential resolves the user and group; it returns nil if there's nothing to change
+func (a Attributes) credential() (*syscall.Credential, error) {
+	if a.User == "" && a.Group == "" {
+		return nil, nil
+	}
+
+	uid := uint32(os.Geteuid())
+	gid := uint32(os.Getegid())
+	var groups []uint32
+
+	if a.User != "" {
+		u, err := lookupUser(a.User)
+		if err != nil {
+			return nil, err
+		}
+
+		uid = parseID(u.Uid)
+		gid = parseID(u.Gid)
+
+		groupIDs, err := u.GroupIds()
+		if err == nil {
+			for _, groupID := range groupIDs {
+				groups = append(groups, parseID(groupID))
+			}
+		}
+	}
+
+	if a.Group != "" {
+		g, err := lookupGroup(a.Group)
+		if err != nil {
+			return nil, err
+		}
+
+		gid = parseID(g.Gid)
+	}
+
+	if os.Geteuid() != 0 {
+		if uid != uint32(os.Geteuid()) || gid != uint32(os.Getegid()) {
+			return nil, fmt.Errorf("dspo must be running as root to run as user %#+v / group %#+v", a.User, a.Group)
+		}
+
+		// already who we want to be
+		return nil, nil
+	}
+
+	return &syscall.Credential{
+		Uid:    uid,
+		Gid:    gid,
+		Groups: groups,
+	}, nil
+}
+
+// Validate checks that the working dir exists and that the user and group can be resolved (and switched to)
+func (a Attributes) Validate() error {
+	if a.WorkingDir != "" {
+		info, err := os.Stat(a.WorkingDir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("working dir %v does not exist", a.WorkingDir)
+			}
+
+			return fmt.Errorf("failed to stat working dir %v: %v", a.WorkingDir, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("working dir %v is not a directory", a.WorkingDir)
+		}
+	}
+
+	_, err := a.credential()
+	if err != nil {
+		return err
+	}
+
+	if a.Umask != nil && *a.Umask > 0o777 {
+		return fmt.Errorf("umask %#o is out of range", *a.Umask)
+	}
+
+	return nil
+}
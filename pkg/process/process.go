@@ -1,26 +1,109 @@
 package process
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long to wait for the output to drain after the process exits (e.g. if a grandchild holds on to it)
+	waitDelay = time.Second * 1
+	// how often to check whether anything is left in the process group while stopping
+	groupPollInterval = time.Millisecond * 50
+	// how long to wait for the rest of the process group to go once it's been killed (SIGKILL can't be ignored, but it
+	// can take a moment for the kernel to get to it)
+	groupKillTimeout = time.Second
+	procPath         = "/proc"
+	umaskShell       = "/bin/sh"
+)
+
+// StopOutcome describes how a process came to exit when it was asked to stop
+type StopOutcome string
+
+const (
+	// AlreadyExited means the process had exited before it was asked to stop
+	AlreadyExited StopOutcome = "already-exited"
+	// ExitedOnSignal means the process exited within the grace period after being sent the stop signal
+	ExitedOnSignal StopOutcome = "exited-on-signal"
+	// Killed means the process had to be killed (e.g. because it outlived the grace period)
+	Killed StopOutcome = "killed"
 )
 
 type Process struct {
 	cmd        *exec.Cmd
-	wg         sync.WaitGroup
+	pgid       int
+	done       chan struct{}
 	err        error
 	mu         sync.Mutex
 	returnCode int
+	exitSignal syscall.Signal
+	startedAt  time.Time
+	endedAt    time.Time
+	killed     bool
 }
 
+// Run runs the given command with the given shell (i.e. shell -c command)
 func Run(
 	shell string,
 	command string,
 	env []string,
 	inheritEnv bool,
+	attributes Attributes,
+	stdoutPipe io.Writer,
+	stderrPipe io.Writer,
+) *Process {
+	return run(exec.Command(shell, "-c", command), env, inheritEnv, attributes, stdoutPipe, stderrPipe)
+}
+
+// RunArgv runs the given argv directly (i.e. without a shell), so that signals reach the program itself
+func RunArgv(
+	argv []string,
+	env []string,
+	inheritEnv bool,
+	attributes Attributes,
+	stdoutPipe io.Writer,
+	stderrPipe io.Writer,
+) *Process {
+	if len(argv) == 0 {
+		p := &Process{
+			done:       make(chan struct{}),
+			err:        fmt.Errorf("empty argv"),
+			returnCode: -1,
+		}
+		close(p.done)
+
+		return p
+	}
+
+	return run(exec.Command(argv[0], argv[1:]...), env, inheritEnv, attributes, stdoutPipe, stderrPipe)
+}
+
+// withUmask returns the given command wrapped so as to set the given umask before exec'ing it (in the same process, so
+// that it's still what gets signalled)
+func withUmask(cmd *exec.Cmd, umask os.FileMode) *exec.Cmd {
+	args := []string{umaskShell, "-c", fmt.Sprintf("umask %04o && exec \"$0\" \"$@\"", umask), cmd.Path}
+	args = append(args, cmd.Args[1:]...)
+
+	return &exec.Cmd{
+		Path: umaskShell,
+		Args: args,
+	}
+}
+
+func run(
+	cmd *exec.Cmd,
+	env []string,
+	inheritEnv bool,
+	attributes Attributes,
 	stdoutPipe io.Writer,
 	stderrPipe io.Writer,
 ) *Process {
@@ -36,32 +119,64 @@ func Run(
 		actualEnv = append(actualEnv, v)
 	}
 
+	// the umask is process-wide, so rather than setting it for ourselves (and so for every file we create in the
+	// meantime) while starting the process, the process sets it for itself on the way in
+	if attributes.Umask != nil && cmd.Err == nil {
+		cmd = withUmask(cmd, *attributes.Umask)
+	}
+
 	p := &Process{
-		cmd: exec.Command(
-			shell,
-			"-c",
-			command,
-		),
+		cmd:        cmd,
+		done:       make(chan struct{}),
 		returnCode: -1,
 	}
 	p.cmd.Env = actualEnv
 	p.cmd.Stdout = stdoutPipe
 	p.cmd.Stderr = stderrPipe
+	p.cmd.WaitDelay = waitDelay
+	// in its own process group, so that the whole tree (e.g. npm -> node) can be signalled at once
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	p.cmd.Dir = attributes.WorkingDir
+
+	credential, err := attributes.credential()
+	if err != nil {
+		p.err = err
+		close(p.done)
+		return p
+	}
+	p.cmd.SysProcAttr.Credential = credential
+
+	// started here rather than in the goroutine so that the process is there to be signalled as soon as we return
+	err = p.cmd.Start()
+	if err != nil {
+		p.err = err
+		close(p.done)
+		return p
+	}
+
+	p.pgid = p.cmd.Process.Pid
+	p.startedAt = time.Now()
 
-	p.wg.Add(1)
 	go func() {
-		err := p.cmd.Run()
+		err := p.cmd.Wait()
 
 		p.mu.Lock()
 		p.err = err
+		p.endedAt = time.Now()
 		if p.cmd.ProcessState != nil {
 			p.returnCode = p.cmd.ProcessState.ExitCode()
+
+			waitStatus, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+			if ok && waitStatus.Signaled() {
+				p.exitSignal = waitStatus.Signal()
+			}
 		}
 		p.mu.Unlock()
 
-		p.wg.Done()
+		close(p.done)
 	}()
-	runtime.Gosched()
 
 	return p
 }
@@ -74,7 +189,7 @@ func (p *Process) Error() error {
 }
 
 func (p *Process) Wait() error {
-	p.wg.Wait()
+	<-p.done
 
 	return p.Error()
 }
@@ -86,10 +201,215 @@ func (p *Process) ReturnCode() int {
 	return p.returnCode
 }
 
+// Signal returns the signal that terminated the process (if it was terminated by a signal; 0 otherwise)
+func (p *Process) Signal() syscall.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.exitSignal
+}
+
+// StartedAt returns when the process was started (the zero time if it couldn't be)
+func (p *Process) StartedAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.startedAt
+}
+
+// EndedAt returns when the process was found to have exited (the zero time if it hasn't)
+func (p *Process) EndedAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.endedAt
+}
+
+func (p *Process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal sends the given signal to every process in the process group
+func (p *Process) signal(signal syscall.Signal) error {
+	if p.pgid <= 0 {
+		return syscall.ESRCH
+	}
+
+	return syscall.Kill(-p.pgid, signal)
+}
+
+// groupMembers returns the pids of the (non-zombie) processes left in the process group
+func (p *Process) groupMembers() []int {
+	if p.pgid <= 0 {
+		return nil
+	}
+
+	return getGroupMembers(p.pgid)
+}
+
+func (p *Process) groupAlive() bool {
+	if p.pgid <= 0 {
+		return false
+	}
+
+	_, err := os.Stat(procPath)
+	if err != nil {
+		// no procfs to look through, so settle for whether anything at all (zombies included) is left in the group
+		return syscall.Kill(-p.pgid, 0) == nil
+	}
+
+	return len(p.groupMembers()) > 0
+}
+
+// Stop sends the given signal to the process group and waits up to the grace period for the process and anything it
+// started to exit, killing the whole group if they don't
+func (p *Process) Stop(signal syscall.Signal, gracePeriod time.Duration) StopOutcome {
+	if p.exited() && !p.groupAlive() {
+		return AlreadyExited
+	}
+
+	err := p.signal(signal)
+	if err != nil {
+		// most likely it all exited in the meantime
+		_ = p.Wait()
+		return AlreadyExited
+	}
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-p.done:
+	case <-timer.C:
+		return p.kill()
+	}
+
+	// the process itself has gone, but anything it started may still be on its way out
+	if p.groupAlive() {
+		ticker := time.NewTicker(groupPollInterval)
+		defer ticker.Stop()
+
+		for p.groupAlive() {
+			select {
+			case <-ticker.C:
+			case <-timer.C:
+				return p.kill()
+			}
+		}
+	}
+
+	p.mu.Lock()
+	killed := p.killed
+	p.mu.Unlock()
+
+	// someone else may have lost patience with us and killed it during the grace period
+	if killed {
+		return Killed
+	}
+
+	return ExitedOnSignal
+}
+
+func (p *Process) kill() StopOutcome {
+	p.Close()
+
+	_ = p.Wait()
+
+	// the process itself has gone, but the rest of the group may not have yet
+	if p.groupAlive() {
+		timer := time.NewTimer(groupKillTimeout)
+		defer timer.Stop()
+
+		ticker := time.NewTicker(groupPollInterval)
+		defer ticker.Stop()
+
+		for p.groupAlive() {
+			select {
+			case <-ticker.C:
+			case <-timer.C:
+				return Killed
+			}
+		}
+	}
+
+	return Killed
+}
+
+// Close kills the process group without waiting for it to exit
 func (p *Process) Close() {
-	if p.cmd != nil && p.cmd.Process != nil {
-		_ = p.cmd.Process.Kill()
+	if p.exited() && !p.groupAlive() {
+		return
+	}
+
+	p.mu.Lock()
+	p.killed = true
+	p.mu.Unlock()
+
+	_ = p.signal(syscall.SIGKILL)
+}
+
+// Lingering reports whether the process has exited but left something behind in its process group
+func (p *Process) Lingering() bool {
+	return p.exited() && p.groupAlive()
+}
+
+// Sweep kills anything still left in the process group (e.g. something that ignored the stop signal after its parent
+// went away) and returns the pids it found
+func (p *Process) Sweep() []int {
+	pids := p.groupMembers()
+	if len(pids) == 0 {
+		return pids
+	}
+
+	_ = p.signal(syscall.SIGKILL)
+
+	return pids
+}
+
+// getGroupMembers looks through procfs for the (non-zombie) processes in the given process group
+func getGroupMembers(pgid int) []int {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil
+	}
+
+	pids := make([]int, 0)
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(procPath, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		// the command name is in brackets and may contain anything, so the fields are taken from after it; they're
+		// state, ppid and pgrp in that order
+		i := bytes.LastIndexByte(b, ')')
+		if i < 0 {
+			continue
+		}
+
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 3 || fields[0] == "Z" || fields[0] == "X" {
+			continue
+		}
+
+		processPGID, err := strconv.Atoi(fields[2])
+		if err != nil || processPGID != pgid {
+			continue
+		}
+
+		pids = append(pids, pid)
 	}
 
-	return
+	return pids
 }
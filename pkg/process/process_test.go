@@ -2,7 +2,11 @@ package process
 
 import (
 	"io"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -28,6 +32,7 @@ func TestRun(t *testing.T) {
 			"echo 'first'; sleep 0.1; echo 'second'",
 			nil,
 			true,
+			Attributes{},
 			stdoutWriter,
 			stderrWriter,
 		)
@@ -62,6 +67,7 @@ func TestRun(t *testing.T) {
 			"echo 'first'; sleep 0.1; echo 'second'; false",
 			nil,
 			true,
+			Attributes{},
 			stdoutWriter,
 			stderrWriter,
 		)
@@ -96,6 +102,7 @@ func TestRun(t *testing.T) {
 			"not-a-command",
 			nil,
 			true,
+			Attributes{},
 			stdoutWriter,
 			stderrWriter,
 		)
@@ -109,4 +116,204 @@ func TestRun(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, "/bin/bash: not-a-command: command not found\n", string(out))
 	})
+
+	t.Run("StopAlreadyExited", func(t *testing.T) {
+		p := Run(
+			"/bin/bash",
+			"true",
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		_ = p.Wait()
+
+		require.Equal(t, AlreadyExited, p.Stop(syscall.SIGTERM, time.Second*1))
+	})
+
+	t.Run("StopExitedOnSignal", func(t *testing.T) {
+		p := Run(
+			"/bin/bash",
+			"trap 'exit 0' TERM; while true; do sleep 0.1; done",
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		time.Sleep(time.Millisecond * 200)
+
+		require.Equal(t, ExitedOnSignal, p.Stop(syscall.SIGTERM, time.Second*5))
+		require.Equal(t, 0, p.ReturnCode())
+	})
+
+	t.Run("StopKilled", func(t *testing.T) {
+		p := Run(
+			"/bin/bash",
+			"trap '' TERM; while true; do sleep 0.1; done",
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		time.Sleep(time.Millisecond * 200)
+
+		before := time.Now()
+		require.Equal(t, Killed, p.Stop(syscall.SIGTERM, time.Millisecond*500))
+		require.GreaterOrEqual(t, time.Since(before), time.Millisecond*500)
+	})
+
+	t.Run("StopKillsProcessGroup", func(t *testing.T) {
+		p := Run(
+			"/bin/bash",
+			"bash -c \"trap '' TERM; sleep 100\" & wait",
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		time.Sleep(time.Millisecond * 200)
+		require.GreaterOrEqual(t, len(p.groupMembers()), 2)
+
+		require.Equal(t, Killed, p.Stop(syscall.SIGTERM, time.Millisecond*500))
+		require.Empty(t, p.groupMembers())
+		require.Empty(t, p.Sweep())
+	})
+
+	t.Run("StopLingering", func(t *testing.T) {
+		p := Run(
+			"/bin/bash",
+			"sleep 100 &",
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		_ = p.Wait()
+		require.True(t, p.Lingering())
+
+		require.Equal(t, ExitedOnSignal, p.Stop(syscall.SIGTERM, time.Second*1))
+		require.False(t, p.Lingering())
+	})
+
+	t.Run("RunArgv", func(t *testing.T) {
+		p := RunArgv(
+			[]string{"/bin/bash", "-c", "exit 3"},
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		require.Error(t, p.Wait())
+		require.Equal(t, 3, p.ReturnCode())
+	})
+
+	t.Run("RunArgvEmpty", func(t *testing.T) {
+		p := RunArgv(
+			nil,
+			nil,
+			true,
+			Attributes{},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		require.Error(t, p.Wait())
+		require.Equal(t, AlreadyExited, p.Stop(syscall.SIGTERM, time.Second*1))
+	})
+
+	t.Run("Attributes", func(t *testing.T) {
+		dir := t.TempDir()
+		umask := os.FileMode(0o027)
+
+		attributes := Attributes{
+			WorkingDir: dir,
+			Umask:      &umask,
+		}
+		require.NoError(t, attributes.Validate())
+
+		p := Run(
+			"/bin/bash",
+			"pwd > pwd.txt; umask > umask.txt",
+			nil,
+			true,
+			attributes,
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		require.NoError(t, p.Wait())
+
+		b, err := os.ReadFile(filepath.Join(dir, "pwd.txt"))
+		require.NoError(t, err)
+		require.Equal(t, dir+"\n", string(b))
+
+		b, err = os.ReadFile(filepath.Join(dir, "umask.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "0027\n", string(b))
+
+		// the same goes for exec form, with our own umask left alone throughout
+		ourUmask := syscall.Umask(0o022)
+		syscall.Umask(ourUmask)
+
+		p = RunArgv(
+			[]string{"bash", "-c", "umask > argv_umask.txt; echo \"$0 $1\" > argv.txt", "a b", "c"},
+			nil,
+			true,
+			attributes,
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		require.NoError(t, p.Wait())
+
+		b, err = os.ReadFile(filepath.Join(dir, "argv_umask.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "0027\n", string(b))
+
+		b, err = os.ReadFile(filepath.Join(dir, "argv.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "a b c\n", string(b))
+
+		require.Equal(t, ourUmask, syscall.Umask(ourUmask))
+	})
+
+	t.Run("AttributesInvalid", func(t *testing.T) {
+		require.Error(t, Attributes{WorkingDir: "/does/not/exist"}.Validate())
+		require.Error(t, Attributes{User: "dspo-no-such-user"}.Validate())
+		require.Error(t, Attributes{Group: "dspo-no-such-group"}.Validate())
+
+		p := Run(
+			"/bin/bash",
+			"true",
+			nil,
+			true,
+			Attributes{User: "dspo-no-such-user"},
+			nil,
+			nil,
+		)
+		defer p.Close()
+
+		require.Error(t, p.Wait())
+	})
 }
@@ -1,9 +1,11 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/initialed85/dspo/internal"
@@ -11,29 +13,48 @@ import (
 	"github.com/initialed85/dspo/pkg/fanout"
 	"github.com/initialed85/dspo/pkg/managed_process"
 	"github.com/initialed85/dspo/pkg/probe"
+	"github.com/initialed85/dspo/pkg/process"
+)
+
+const (
+	logsDepth = 1024
+	// heldLogsDepth bounds the logs held back while the service isn't ready, with the oldest dropped to make room (as
+	// many as the system keeps for replay for each service)
+	heldLogsDepth = 4096
 )
 
 type Service struct {
-	managedProcess *managed_process.ManagedProcess
-	startupProbe   *probe.Probe
-	livenessProbe  *probe.Probe
-	onStarted      func()
-	onLive         func()
-	onDead         func()
-	logs           chan managed_process.Log
-	fanout         *fanout.Fanout
-	mu             sync.Mutex
-	logger         *slog.Logger
-	started        bool
-	startupReady   bool
-	livenessReady  bool
-	name           string
+	managedProcess           *managed_process.ManagedProcess
+	startupProbe             *probe.Probe
+	livenessProbe            *probe.Probe
+	readinessProbe           *probe.Probe
+	restartOnStartupFailure  bool
+	restartOnLivenessFailure bool
+	onStarted                func()
+	onLive                   func()
+	onDead                   func()
+	logs                     chan managed_process.Log
+	fanout                   *fanout.LogFanout
+	logsReady                chan struct{} // closed while the service's logs are to be passed on (i.e. it's ready)
+	logsReadyMu              sync.Mutex    // separate from mu, as the gates can't wait on anything that might block
+	heldLogsDropped          atomic.Uint64
+	mu                       sync.Mutex
+	logger                   *slog.Logger
+	started                  bool
+	startupReady             bool
+	livenessReady            bool
+	readinessReady           bool
+	notifiedStarted          bool
+	generation               int // bumped whenever the probes start over, so that a stale restart can be told apart
+	restarting               bool
+	name                     string
 }
 
 func New(
 	managedProcessArgs common.ManagedProcessArgs,
 	startupProbeArgs *common.StartupProbeArgs,
 	livenessProbeArgs *common.LivenessProbeArgs,
+	readinessProbeArgs *common.ReadinessProbeArgs,
 	onStartupReady func(),
 	onLivenessReady func(),
 	onLivenessNotReady func(),
@@ -43,73 +64,414 @@ func New(
 		onStarted: onStartupReady,
 		onLive:    onLivenessReady,
 		onDead:    onLivenessNotReady,
-		logs:      make(chan managed_process.Log),
+		logs:      make(chan managed_process.Log, logsDepth),
 		logger:    internal.GetLogger(name),
+		logsReady: make(chan struct{}),
 		name:      name,
 	}
 
 	s.managedProcess = managed_process.New(
 		s.logs,
-		managedProcessArgs.RestartPolicy,
-		managedProcessArgs.Shell,
-		managedProcessArgs.Command,
-		managedProcessArgs.Env,
-		managedProcessArgs.InheritEnv,
-		managedProcessArgs.RestartWaitDuration,
+		managedProcessArgs,
 		func(returnCode int) {},
 		name,
 	)
 
 	if startupProbeArgs != nil {
-		s.startupProbe = probe.New(
+		s.restartOnStartupFailure = startupProbeArgs.RestartOnFailure
+
+		s.startupProbe = newProbe(
 			startupProbeArgs.StartupTolerance,
+			startupProbeArgs.InitialDelay,
 			startupProbeArgs.ProbeInterval,
-			0,
+			startupProbeArgs.SuccessThreshold,
+			startupProbeArgs.FailureThreshold,
 			startupProbeArgs.Command,
-			managedProcessArgs.Env,
-			managedProcessArgs.InheritEnv,
+			startupProbeArgs.Argv,
+			startupProbeArgs.HTTP,
+			startupProbeArgs.Socket,
+			startupProbeArgs.Log,
+			s.subscribeForProbe,
+			managedProcessArgs,
+			startupProbeArgs.Attributes,
+			startupProbeArgs.Timeout,
 			s.startupOnReady,
-			common.NoOpFunc,
+			s.startupOnNotReady,
 			fmt.Sprintf("%v_startup", name),
 		)
 	}
 
+	// liveness and readiness are of no interest until the service is startup ready, at which point they stop being
+	// ignored
 	if livenessProbeArgs != nil {
-		s.livenessProbe = probe.New(
+		s.restartOnLivenessFailure = livenessProbeArgs.RestartOnFailure
+
+		failureThreshold := livenessProbeArgs.FailureThreshold
+		if failureThreshold <= 0 {
+			failureThreshold = livenessProbeArgs.PermittedFailures + 1
+		}
+
+		s.livenessProbe = newProbe(
 			time.Second*60*60*24*365*100,
+			livenessProbeArgs.InitialDelay,
 			livenessProbeArgs.ProbeInterval,
-			livenessProbeArgs.PermittedFailures,
+			livenessProbeArgs.SuccessThreshold,
+			failureThreshold,
 			livenessProbeArgs.Command,
-			managedProcessArgs.Env,
-			managedProcessArgs.InheritEnv,
+			livenessProbeArgs.Argv,
+			livenessProbeArgs.HTTP,
+			livenessProbeArgs.Socket,
+			livenessProbeArgs.Log,
+			s.subscribeForProbe,
+			managedProcessArgs,
+			livenessProbeArgs.Attributes,
+			livenessProbeArgs.Timeout,
 			s.livenessOnReady,
 			s.livenessOnNotReady,
 			fmt.Sprintf("%v_liveness", name),
 		)
 	}
 
+	if readinessProbeArgs != nil {
+		s.readinessProbe = newProbe(
+			time.Second*60*60*24*365*100,
+			readinessProbeArgs.InitialDelay,
+			readinessProbeArgs.ProbeInterval,
+			readinessProbeArgs.SuccessThreshold,
+			readinessProbeArgs.FailureThreshold,
+			readinessProbeArgs.Command,
+			readinessProbeArgs.Argv,
+			readinessProbeArgs.HTTP,
+			readinessProbeArgs.Socket,
+			readinessProbeArgs.Log,
+			s.subscribeForProbe,
+			managedProcessArgs,
+			readinessProbeArgs.Attributes,
+			readinessProbeArgs.Timeout,
+			s.readinessOnReady,
+			s.readinessOnNotReady,
+			fmt.Sprintf("%v_readiness", name),
+		)
+	}
+
+	if s.readinessProbe == nil {
+		close(s.logsReady)
+	}
+
 	return &s
 }
 
-func (s *Service) startupOnReady() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// newProbe returns an HTTP, socket or log probe (the latter subscribing with the given func) if one is given, or
+// otherwise a probe that runs the given command in the same environment as the service
+func newProbe(
+	startupTolerance time.Duration,
+	initialDelay time.Duration,
+	probeInterval time.Duration,
+	successThreshold int,
+	failureThreshold int,
+	command string,
+	argv []string,
+	http *common.HTTPProbeArgs,
+	socket *common.SocketProbeArgs,
+	logs *common.LogProbeArgs,
+	subscribe func() (chan managed_process.Log, func(), error),
+	managedProcessArgs common.ManagedProcessArgs,
+	attributes process.Attributes,
+	timeout time.Duration,
+	onReady func(),
+	onNotReady func(),
+	name string,
+) *probe.Probe {
+	if http != nil {
+		return probe.NewHTTP(
+			startupTolerance,
+			initialDelay,
+			probeInterval,
+			successThreshold,
+			failureThreshold,
+			*http,
+			onReady,
+			onNotReady,
+			name,
+		)
+	}
 
-	if s.startupReady {
-		return
+	if socket != nil {
+		return probe.NewSocket(
+			startupTolerance,
+			initialDelay,
+			probeInterval,
+			successThreshold,
+			failureThreshold,
+			*socket,
+			onReady,
+			onNotReady,
+			name,
+		)
+	}
+
+	if logs != nil {
+		return probe.NewLog(
+			startupTolerance,
+			initialDelay,
+			probeInterval,
+			successThreshold,
+			failureThreshold,
+			*logs,
+			subscribe,
+			onReady,
+			onNotReady,
+			name,
+		)
+	}
+
+	return probe.New(
+		startupTolerance,
+		initialDelay,
+		probeInterval,
+		successThreshold,
+		failureThreshold,
+		command,
+		argv,
+		managedProcessArgs.Env,
+		managedProcessArgs.InheritEnv,
+		attributes,
+		timeout,
+		onReady,
+		onNotReady,
+		name,
+	)
+}
+
+// subscribeForProbe subscribes a log probe to the service's logs; it's called as the probe starts, which happens (with
+// the lock held) once the fanout is in place
+func (s *Service) subscribeForProbe() (chan managed_process.Log, func(), error) {
+	return s.fanout.SubscribeWithPolicy(fanout.Block)
+}
+
+// setLogsReady opens (or closes) the gates on the service's logs
+func (s *Service) setLogsReady(ready bool) {
+	s.logsReadyMu.Lock()
+	defer s.logsReadyMu.Unlock()
+
+	select {
+	case <-s.logsReady:
+		if !ready {
+			s.logsReady = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(s.logsReady)
+		}
+	}
+}
+
+func (s *Service) getLogsReady() chan struct{} {
+	s.logsReadyMu.Lock()
+	defer s.logsReadyMu.Unlock()
+
+	return s.logsReady
+}
+
+// runGate passes on the given logs while the service is ready, holding them back (in order, and up to heldLogsDepth of
+// them) while it isn't
+func (s *Service) runGate(ctx context.Context, logs chan managed_process.Log, gated chan managed_process.Log) {
+	held := make([]managed_process.Log, 0)
+	dropped := uint64(0)
+
+	for {
+		logsReady := s.getLogsReady()
+
+		ready := false
+		select {
+		case <-logsReady:
+			ready = true
+		default:
+		}
+
+		if ready {
+			if dropped > 0 {
+				s.logger.Warn(
+					fmt.Sprintf("dropped the oldest %v logs held back while the service wasn't ready", dropped),
+				)
+				dropped = 0
+			}
+
+			for _, l := range held {
+				select {
+				case <-ctx.Done():
+					return
+				case gated <- l:
+				}
+			}
+
+			held = held[:0]
+
+			// nothing to wait for
+			logsReady = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-logsReady:
+		case l := <-logs:
+			if !ready {
+				if len(held) >= heldLogsDepth {
+					held = held[1:]
+					dropped++
+					s.heldLogsDropped.Add(1)
+				}
+
+				held = append(held, l)
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case gated <- l:
+			}
+		}
 	}
+}
+
+// getProbes returns the probes the service has
+func (s *Service) getProbes() []*probe.Probe {
+	probes := make([]*probe.Probe, 0)
 
+	for _, p := range []*probe.Probe{s.startupProbe, s.livenessProbe, s.readinessProbe} {
+		if p != nil {
+			probes = append(probes, p)
+		}
+	}
+
+	return probes
+}
+
+// setStartupReady notes that the service is startup ready, so that liveness and readiness stop being ignored; it
+// expects the lock to be held
+func (s *Service) setStartupReady() {
 	s.startupReady = true
 
+	for _, p := range []*probe.Probe{s.livenessProbe, s.readinessProbe} {
+		if p != nil {
+			p.SetIgnoreUntil(time.Now().Add(-time.Nanosecond * 1))
+		}
+	}
+
+	s.notifyStarted()
+}
+
+// notifyStarted lets on the service is started (so that its dependents can be started) once it's both startup ready
+// and (if it has a readiness probe) ready; it expects the lock to be held
+func (s *Service) notifyStarted() {
+	if s.notifiedStarted || !s.startupReady || !s.readinessReady {
+		return
+	}
+
+	s.notifiedStarted = true
+
 	if s.onStarted != nil {
 		s.onStarted()
 	}
+}
+
+// restart terminates the service's process (leaving it to the restart policy to bring it back) and starts the probes
+// over, unless that's already happened (or is happening) since the given generation; it's run in a goroutine of its
+// own, as it's brought about by the probes' callbacks
+func (s *Service) restart(generation int, reason string) {
+	s.mu.Lock()
+
+	if !s.started || s.generation != generation || s.restarting {
+		s.mu.Unlock()
+		return
+	}
+
+	s.generation++
+	s.restarting = true
+	generation = s.generation
+
+	s.logger.Warn(fmt.Sprintf("restarting after %v", reason))
+
+	s.managedProcess.Terminate()
 
-	s.livenessProbe.SetIgnoreUntil(time.Now().Add(-time.Nanosecond * 1))
+	probes := s.getProbes()
+
+	for _, p := range probes {
+		_ = p.Stop()
+	}
+
+	s.mu.Unlock()
+
+	// a callback for an attempt from before the restart may be waiting on the lock, and it has nothing to say about the
+	// new process
+	for _, p := range probes {
+		p.WaitForCallbacks()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// stopped (and maybe started again) in the meantime
+	if !s.started || s.generation != generation {
+		return
+	}
+
+	s.generation++
+	s.restarting = false
+
+	// the new process has to prove itself all over again, so there's nothing to go on until the probes pass again
+	if s.startupProbe != nil {
+		s.startupReady = false
+	}
+
+	if s.readinessProbe != nil {
+		s.readinessReady = false
+		s.setLogsReady(false)
+	}
+
+	if s.startupProbe != nil || s.readinessProbe != nil {
+		s.notifiedStarted = false
+	}
+
+	for _, p := range probes {
+		err := p.Start()
+		if err != nil {
+			s.logger.Error("failed to restart probe", "error", err)
+		}
+	}
+
+	// without a startup probe, liveness and readiness are heeded straight away (as they are when it's first started)
+	if s.startupReady {
+		s.setStartupReady()
+	}
+}
+
+func (s *Service) startupOnReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.startupReady {
+		return
+	}
+
+	s.setStartupReady()
 
 	s.logger.Debug("startup ready")
 }
 
+func (s *Service) startupOnNotReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.startupReady || !s.restartOnStartupFailure {
+		return
+	}
+
+	go s.restart(s.generation, "startup probe failures")
+}
+
 func (s *Service) livenessOnReady() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -131,6 +493,10 @@ func (s *Service) livenessOnNotReady() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.restartOnLivenessFailure {
+		go s.restart(s.generation, "liveness probe failures")
+	}
+
 	if !s.livenessReady {
 		return
 	}
@@ -144,6 +510,38 @@ func (s *Service) livenessOnNotReady() {
 	s.logger.Debug("liveness not ready")
 }
 
+func (s *Service) readinessOnReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readinessReady {
+		return
+	}
+
+	s.readinessReady = true
+
+	s.setLogsReady(true)
+
+	s.notifyStarted()
+
+	s.logger.Debug("readiness ready")
+}
+
+func (s *Service) readinessOnNotReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.readinessReady {
+		return
+	}
+
+	s.readinessReady = false
+
+	s.setLogsReady(false)
+
+	s.logger.Debug("readiness not ready")
+}
+
 func (s *Service) Name() string {
 	return s.name
 }
@@ -169,6 +567,41 @@ func (s *Service) LivenessReady() bool {
 	return s.livenessReady
 }
 
+// ProbeHistory holds the most recent results of each of the service's probes (oldest first); there are none for a
+// probe that the service doesn't have
+type ProbeHistory struct {
+	Startup   []probe.Result `json:"startup,omitempty"`
+	Liveness  []probe.Result `json:"liveness,omitempty"`
+	Readiness []probe.Result `json:"readiness,omitempty"`
+}
+
+// ProbeHistory returns the most recent results of each of the service's probes
+func (s *Service) ProbeHistory() ProbeHistory {
+	probeHistory := ProbeHistory{}
+
+	if s.startupProbe != nil {
+		probeHistory.Startup = s.startupProbe.History()
+	}
+
+	if s.livenessProbe != nil {
+		probeHistory.Liveness = s.livenessProbe.History()
+	}
+
+	if s.readinessProbe != nil {
+		probeHistory.Readiness = s.readinessProbe.History()
+	}
+
+	return probeHistory
+}
+
+// ReadinessReady reports whether the service is ready (always true once started, if it has no readiness probe)
+func (s *Service) ReadinessReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readinessReady
+}
+
 func (s *Service) Start() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -178,37 +611,58 @@ func (s *Service) Start() error {
 	}
 
 	s.started = true
-	s.startupReady = s.onStarted == nil
-	s.livenessReady = s.onLive == nil && s.onDead == nil
+	s.startupReady = false
+	s.livenessReady = s.livenessProbe == nil || (s.onLive == nil && s.onDead == nil)
+	s.readinessReady = s.readinessProbe == nil
+	s.notifiedStarted = false
+	s.restarting = false
+	s.generation++
+
+	s.heldLogsDropped.Store(0)
+	s.setLogsReady(s.readinessReady)
 
 	var err error
 
-	err = s.managedProcess.Start()
-	if err != nil {
-		return err
+	// in place before the process starts, so that there's somewhere for its output to go straight away
+	if s.fanout == nil {
+		s.fanout = fanout.New(s.logs)
 	}
 
-	if s.startupProbe != nil {
-		err = s.startupProbe.Start()
+	// the probes start before the process, so that a log probe sees its output from the start
+	probes := s.getProbes()
+
+	for i, p := range probes {
+		err = p.Start()
 		if err != nil {
+			for _, startedProbe := range probes[:i] {
+				_ = startedProbe.Stop()
+			}
+
 			return err
 		}
 	}
 
-	if s.livenessProbe != nil {
-		err = s.livenessProbe.Start()
-		if err != nil {
-			return err
+	err = s.managedProcess.Start()
+	if err != nil {
+		for _, p := range probes {
+			_ = p.Stop()
 		}
+
+		return err
 	}
 
-	s.fanout = fanout.New(s.logs)
+	// without a startup probe there's nothing to wait for, so dependents can start straight away (or as soon as the
+	// service is ready, if it has a readiness probe)
+	if s.startupProbe == nil {
+		s.setStartupReady()
+	}
 
 	s.logger.Debug("started")
 
 	return nil
 }
 
+// Stop stops the probes and the process, waiting for the process to exit
 func (s *Service) Stop() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -217,18 +671,19 @@ func (s *Service) Stop() error {
 		return fmt.Errorf("not started")
 	}
 
-	if s.livenessProbe != nil {
-		_ = s.livenessProbe.Stop()
+	s.generation++
 
-		if s.livenessReady {
-			if s.onDead != nil {
-				s.onDead()
-			}
-		}
+	for _, p := range s.getProbes() {
+		_ = p.Stop()
 	}
 
-	if s.startupProbe != nil {
-		_ = s.startupProbe.Stop()
+	// whatever's been held back (and whatever comes of stopping) is passed on, so that nothing is lost
+	s.setLogsReady(true)
+
+	if s.livenessProbe != nil && s.livenessReady {
+		if s.onDead != nil {
+			s.onDead()
+		}
 	}
 
 	_ = s.managedProcess.Stop()
@@ -239,21 +694,110 @@ func (s *Service) Stop() error {
 	}
 
 	s.started = false
+	s.startupReady = false
+	s.livenessReady = false
+	s.readinessReady = false
+	s.notifiedStarted = false
+	s.restarting = false
 
 	s.logger.Debug("stopped")
 
 	return nil
 }
 
+// Kill forcefully kills the service's process (e.g. if Stop is taking too long); it doesn't wait and it doesn't take the
+// lock, as it's expected to be called while Stop holds it
+func (s *Service) Kill() {
+	s.managedProcess.Kill()
+}
+
+// Failed reports whether the service's process has been given up on after hitting the restart limit
+func (s *Service) Failed() bool {
+	return s.managedProcess.Failed()
+}
+
+// CrashLooping reports whether the service's process is exiting (and being restarted) too often
+func (s *Service) CrashLooping() bool {
+	return s.managedProcess.CrashLooping()
+}
+
+// Running reports whether the service's process is running (or waiting to be restarted)
+func (s *Service) Running() bool {
+	return s.managedProcess.Running()
+}
+
+// Restarts returns the number of times the service's process has been restarted since the service was started
+func (s *Service) Restarts() int {
+	return s.managedProcess.Restarts()
+}
+
+// History returns the most recent runs of the service's process (oldest first)
+func (s *Service) History() []managed_process.Run {
+	return s.managedProcess.History()
+}
+
+// StopOutcome reports how the service's process came to exit the last time it was stopped
+func (s *Service) StopOutcome() process.StopOutcome {
+	return s.managedProcess.StopOutcome()
+}
+
+// SubscribeToLogs subscribes to the service's logs with the default policy (drop-newest)
 func (s *Service) SubscribeToLogs() (chan managed_process.Log, func(), error) {
+	return s.SubscribeToLogsWithPolicy(fanout.DropNewest)
+}
+
+// SubscribeToLogsWithPolicy subscribes to the service's logs with the given policy for when the subscriber isn't
+// keeping up; it can be called before Start (so as not to miss anything), but the subscription ends with Stop
+func (s *Service) SubscribeToLogsWithPolicy(policy fanout.Policy) (chan managed_process.Log, func(), error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.fanout == nil {
-		return nil, nil, fmt.Errorf("no fanout to subscribe to (not started?)")
+		s.fanout = fanout.New(s.logs)
+	}
+
+	return s.fanout.SubscribeWithPolicy(policy)
+}
+
+// SubscribeToReadyLogs subscribes to the service's logs as for SubscribeToLogsWithPolicy with fanout.Block, but holds
+// them back while the service isn't ready (as per its readiness probe), passing them on in order once it is; it's how
+// the service's logs are routed to the rest of the system
+func (s *Service) SubscribeToReadyLogs() (chan managed_process.Log, func(), error) {
+	logs, unsubscribe, err := s.SubscribeToLogsWithPolicy(fanout.Block)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	logs, cancel := s.fanout.Subscribe()
+	gated := make(chan managed_process.Log, logsDepth)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		s.runGate(ctx, logs, gated)
+	}()
+
+	var once sync.Once
+
+	return gated, func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			unsubscribe()
+		})
+	}, nil
+}
+
+// DroppedLogs returns the number of logs dropped since the service was started, for subscribers that weren't keeping up
+// or for having been held back for too long while the service wasn't ready
+func (s *Service) DroppedLogs() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fanout == nil {
+		return s.heldLogsDropped.Load()
+	}
 
-	return logs, cancel, nil
+	return s.fanout.Dropped() + s.heldLogsDropped.Load()
 }
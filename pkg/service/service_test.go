@@ -1,13 +1,21 @@
 package service
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/initialed85/dspo/pkg/common"
 	"github.com/initialed85/dspo/pkg/managed_process"
 	"github.com/initialed85/dspo/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -63,6 +71,7 @@ func TestNew(t *testing.T) {
 				PermittedFailures: 3,
 				Command:           livenessProbeHarness.GetExecutablePath(),
 			},
+			nil,
 			func() {
 				started = true
 			},
@@ -116,4 +125,313 @@ func TestNew(t *testing.T) {
 			time.Millisecond*50,
 		)
 	})
+	t.Run("LogProbe", func(t *testing.T) {
+		var started atomic.Bool
+		var live atomic.Bool
+
+		s := New(
+			common.ManagedProcessArgs{
+				RestartPolicy: managed_process.Never,
+				Shell:         "/bin/bash",
+				// the first line comes straight away, before anything else could have subscribed to the logs
+				Command:    "echo 'listening on :8080'; sleep 0.5; echo 'FATAL: out of cheese' >&2; sleep 5",
+				InheritEnv: true,
+			},
+			&common.StartupProbeArgs{
+				ProbeInterval: time.Millisecond * 50,
+				Log: &common.LogProbeArgs{
+					Stream:  "stdout",
+					Matches: regexp.MustCompile("^listening on "),
+				},
+			},
+			&common.LivenessProbeArgs{
+				ProbeInterval:     time.Millisecond * 50,
+				PermittedFailures: 2,
+				Log: &common.LogProbeArgs{
+					Matches:        regexp.MustCompile("^listening on "),
+					FailureMatches: regexp.MustCompile("^FATAL: "),
+				},
+			},
+			nil,
+			func() {
+				started.Store(true)
+			},
+			func() {
+				live.Store(true)
+			},
+			func() {
+				live.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		require.Eventually(t, started.Load, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, live.Load, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, func() bool { return !live.Load() }, time.Second*5, time.Millisecond*10)
+		require.True(t, s.StartupReady())
+	})
+	t.Run("ReadinessProbe", func(t *testing.T) {
+		var ready atomic.Bool
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ready.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		var startedCount atomic.Int64
+
+		s := New(
+			common.ManagedProcessArgs{
+				RestartPolicy: managed_process.Never,
+				Shell:         "/bin/bash",
+				Command:       "sleep 10",
+				InheritEnv:    true,
+			},
+			nil,
+			nil,
+			&common.ReadinessProbeArgs{
+				ProbeInterval:    time.Millisecond * 50,
+				SuccessThreshold: 2,
+				FailureThreshold: 1,
+				HTTP:             &common.HTTPProbeArgs{URL: server.URL},
+			},
+			func() {
+				startedCount.Add(1)
+			},
+			nil,
+			nil,
+			"test",
+		)
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		// startup ready (as there's no startup probe), but dependents wait for it to be ready as well
+		require.True(t, s.StartupReady())
+		time.Sleep(time.Millisecond * 250)
+		require.False(t, s.ReadinessReady())
+		require.Equal(t, int64(0), startedCount.Load())
+
+		ready.Store(true)
+		require.Eventually(t, s.ReadinessReady, time.Second*5, time.Millisecond*10)
+		require.Equal(t, int64(1), startedCount.Load())
+
+		// it comes and goes without restarting anything or letting on more than once
+		ready.Store(false)
+		require.Eventually(t, func() bool { return !s.ReadinessReady() }, time.Second*5, time.Millisecond*10)
+		ready.Store(true)
+		require.Eventually(t, s.ReadinessReady, time.Second*5, time.Millisecond*10)
+		require.Equal(t, int64(1), startedCount.Load())
+		require.Equal(t, 0, s.Restarts())
+
+		// the probe's ups and downs are there to see
+		probeHistory := s.ProbeHistory()
+		require.Empty(t, probeHistory.Startup)
+		require.Empty(t, probeHistory.Liveness)
+		require.NotEmpty(t, probeHistory.Readiness)
+
+		failed := false
+		for _, result := range probeHistory.Readiness {
+			if !result.OK {
+				failed = true
+				require.Equal(t, "status 503 not within 200 - 399", result.Error)
+				require.False(t, result.TimedOut)
+			}
+		}
+		require.True(t, failed)
+	})
+	t.Run("RestartOnLivenessFailure", func(t *testing.T) {
+		var healthy atomic.Bool
+		healthy.Store(true)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		var live atomic.Bool
+
+		s := New(
+			common.ManagedProcessArgs{
+				RestartPolicy:       managed_process.UnlessStopped,
+				Shell:               "/bin/bash",
+				Command:             "sleep 10",
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+			},
+			nil,
+			&common.LivenessProbeArgs{
+				ProbeInterval:    time.Millisecond * 50,
+				FailureThreshold: 2,
+				RestartOnFailure: true,
+				HTTP:             &common.HTTPProbeArgs{URL: server.URL},
+			},
+			nil,
+			nil,
+			func() {
+				live.Store(true)
+			},
+			func() {
+				live.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		require.Eventually(t, live.Load, time.Second*5, time.Millisecond*10)
+
+		healthy.Store(false)
+		require.Eventually(t, func() bool { return !live.Load() }, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, func() bool { return s.Restarts() >= 1 }, time.Second*5, time.Millisecond*10)
+
+		history := s.History()
+		require.GreaterOrEqual(t, len(history), 1)
+		assert.True(t, history[0].Stopped)
+
+		// once it's healthy again the restarts stop
+		healthy.Store(true)
+		require.Eventually(t, live.Load, time.Second*5, time.Millisecond*10)
+		time.Sleep(time.Millisecond * 250) // for any restart that was already underway
+		restarts := s.Restarts()
+		time.Sleep(time.Millisecond * 500)
+		require.Equal(t, restarts, s.Restarts())
+		require.True(t, s.Running())
+	})
+
+	t.Run("RestartWaitsForStartupAgain", func(t *testing.T) {
+		dir := t.TempDir()
+		healthyPath := filepath.Join(dir, "healthy")
+		sickPath := filepath.Join(dir, "sick")
+
+		var started atomic.Bool
+		var live atomic.Bool
+
+		s := New(
+			common.ManagedProcessArgs{
+				RestartPolicy: managed_process.UnlessStopped,
+				Shell:         "/bin/bash",
+				// takes a while to become healthy, and is no longer healthy once it's gone
+				Command: fmt.Sprintf(
+					"trap 'rm -f %[1]v; exit 0' TERM; rm -f %[1]v; sleep 1; touch %[1]v; echo healthy; "+
+						"while true; do sleep 0.1; done",
+					healthyPath,
+				),
+				InheritEnv:          true,
+				RestartWaitDuration: time.Millisecond * 50,
+			},
+			&common.StartupProbeArgs{
+				ProbeInterval: time.Millisecond * 50,
+				Log:           &common.LogProbeArgs{Matches: regexp.MustCompile("^healthy")},
+			},
+			&common.LivenessProbeArgs{
+				ProbeInterval:    time.Millisecond * 50,
+				FailureThreshold: 2,
+				RestartOnFailure: true,
+				Command:          fmt.Sprintf("test -f %v && ! test -f %v", healthyPath, sickPath),
+			},
+			&common.ReadinessProbeArgs{
+				ProbeInterval: time.Millisecond * 50,
+				Log:           &common.LogProbeArgs{Matches: regexp.MustCompile("^healthy")},
+			},
+			func() {
+				started.Store(true)
+			},
+			func() {
+				live.Store(true)
+			},
+			func() {
+				live.Store(false)
+			},
+			"test",
+		)
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		require.Eventually(t, live.Load, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, s.ReadinessReady, time.Second*5, time.Millisecond*10)
+		require.True(t, started.Load())
+
+		// one bout of sickness brings about a single restart
+		require.NoError(t, os.WriteFile(sickPath, []byte{}, 0o644))
+		require.Eventually(t, func() bool { return s.Restarts() >= 1 }, time.Second*5, time.Millisecond*10)
+		require.NoError(t, os.Remove(sickPath))
+		started.Store(false)
+
+		// the new process isn't judged until it's startup ready, and isn't ready until it's healthy
+		require.False(t, s.StartupReady())
+		require.False(t, s.ReadinessReady())
+
+		require.Eventually(t, func() bool { return live.Load() && s.ReadinessReady() }, time.Second*5, time.Millisecond*10)
+		require.True(t, started.Load())
+		require.Equal(t, 1, s.Restarts())
+		time.Sleep(time.Millisecond * 500)
+		require.Equal(t, 1, s.Restarts())
+	})
+
+	t.Run("HeldLogsAreBounded", func(t *testing.T) {
+		s := New(
+			common.ManagedProcessArgs{
+				RestartPolicy: managed_process.Never,
+				Shell:         "/bin/bash",
+				Command:       fmt.Sprintf("seq 1 %v; sleep 10", heldLogsDepth+100),
+				InheritEnv:    true,
+			},
+			nil,
+			nil,
+			&common.ReadinessProbeArgs{
+				ProbeInterval: time.Millisecond * 50,
+				Command:       "false",
+			},
+			nil,
+			nil,
+			nil,
+			"test",
+		)
+
+		logs, unsubscribe, err := s.SubscribeToReadyLogs()
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		require.NoError(t, s.Start())
+
+		// never ready, so the oldest of what's held back makes way for the rest
+		require.Eventually(t, func() bool { return s.DroppedLogs() == 100 }, time.Second*5, time.Millisecond*10)
+
+		select {
+		case l := <-logs:
+			require.FailNow(t, "got logs before the service was ready", "%#+v", string(l.Data))
+		default:
+		}
+
+		// what's left is passed on once the service is stopped
+		go func() {
+			_ = s.Stop()
+		}()
+
+		for i := 101; i <= heldLogsDepth+100; i++ {
+			select {
+			case l := <-logs:
+				require.Equal(t, fmt.Sprintf("%v\n", i), string(l.Data))
+			case <-time.After(time.Second * 5):
+				require.FailNow(t, "timed out waiting for logs", "got up to %v", i-1)
+			}
+		}
+
+		require.Eventually(t, func() bool { return !s.Started() }, time.Second*5, time.Millisecond*10)
+		require.Equal(t, uint64(100), s.DroppedLogs())
+	})
 }
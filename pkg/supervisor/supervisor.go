@@ -0,0 +1,507 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/initialed85/dspo/internal"
+	"github.com/initialed85/dspo/pkg/config"
+	"github.com/initialed85/dspo/pkg/control"
+	"github.com/initialed85/dspo/pkg/logstore"
+	"github.com/initialed85/dspo/pkg/system"
+)
+
+const (
+	StateDirName    = ".dspo"
+	stateFileName   = "state.json"
+	stoppedFileName = "stopped.json"
+	socketFileName  = "control.sock"
+	lockFileName    = "supervisor.lock"
+	logFileName     = "supervisor.log"
+	logFilesKept    = 3 // the logs of this many previous supervisors are kept (as supervisor.log.1 and so on)
+	logDirName      = "logs"
+	spawnTimeout    = time.Second * 10
+	spawnInterval   = time.Millisecond * 50
+)
+
+// State is written to the state dir for as long as a supervisor is running, so that later invocations can find it
+type State struct {
+	PID        int       `json:"pid"`
+	Name       string    `json:"name"`
+	ConfigPath string    `json:"config_path"`
+	SocketPath string    `json:"socket_path"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// Alive reports whether the process named by the state still exists
+func (s *State) Alive() bool {
+	if s.PID <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(s.PID, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// StateDir returns the state dir for the project holding the given service file
+func StateDir(configPath string) (string, error) {
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(absPath), StateDirName), nil
+}
+
+// LogDir returns the dir holding the log store for the project holding the given service file
+func LogDir(configPath string) (string, error) {
+	stateDir, err := StateDir(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(stateDir, logDirName), nil
+}
+
+// ReadState returns the state of the live supervisor for the given state dir; os.ErrNotExist is returned if there is
+// no state file or if the state file is stale
+func ReadState(stateDir string) (*State, error) {
+	b, err := os.ReadFile(filepath.Join(stateDir, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	state := State{}
+
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %v", err)
+	}
+
+	if !state.Alive() {
+		return nil, os.ErrNotExist
+	}
+
+	return &state, nil
+}
+
+// writeJSON writes the given value to a file in the state dir, via a temp file so that readers never see half of it
+func writeJSON(stateDir string, fileName string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(stateDir, fmt.Sprintf(".%v.%v", fileName, os.Getpid()))
+
+	err = os.WriteFile(tempPath, b, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, filepath.Join(stateDir, fileName))
+}
+
+func writeState(stateDir string, state State) error {
+	return writeJSON(stateDir, stateFileName, state)
+}
+
+// readStopped returns the services that were manually stopped, as persisted by a previous (or the current) supervisor
+func readStopped(stateDir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(stateDir, stoppedFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	names := make([]string, 0)
+
+	err = json.Unmarshal(b, &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stopped file: %v", err)
+	}
+
+	return names, nil
+}
+
+type Supervisor struct {
+	configPath string
+	stateDir   string
+	config     *config.Config
+	system     *system.System
+	server     *control.Server
+	store      *logstore.Store
+	lockFile   *os.File
+	done       chan struct{}
+	doneOnce   sync.Once
+	mu         sync.Mutex
+	started    bool
+	logger     *slog.Logger
+}
+
+func New(
+	configPath string,
+) (*Supervisor, error) {
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := config.Load(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceArgs, err := c.ServiceArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	stateDir, err := StateDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Supervisor{
+		configPath: absPath,
+		stateDir:   stateDir,
+		config:     c,
+		system:     system.New(serviceArgs, c.Name),
+		done:       make(chan struct{}),
+		logger:     internal.GetLogger(fmt.Sprintf("%v_supervisor", c.Name)),
+	}
+
+	s.store = logstore.New(
+		filepath.Join(stateDir, logDirName),
+		logstore.DefaultMaxSize,
+		logstore.DefaultMaxAge,
+		logstore.DefaultMaxSegments,
+		s.system.SubscribeToLogsWithPolicy,
+		fmt.Sprintf("%v_logstore", c.Name),
+	)
+
+	s.server = control.NewServer(
+		filepath.Join(stateDir, socketFileName),
+		s.system,
+		filepath.Join(stateDir, logDirName),
+		func() {
+			s.doneOnce.Do(func() {
+				close(s.done)
+			})
+		},
+		fmt.Sprintf("%v_control", c.Name),
+	)
+
+	return &s, nil
+}
+
+func (s *Supervisor) lock() error {
+	err := os.MkdirAll(s.stateDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(s.stateDir, lockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = lockFile.Close()
+
+		state, readErr := ReadState(s.stateDir)
+		if readErr == nil {
+			return fmt.Errorf("project %#+v is already running under supervisor pid %v", s.config.Name, state.PID)
+		}
+
+		return fmt.Errorf("project %#+v is already running (failed to lock %v: %v)", s.config.Name, lockFile.Name(), err)
+	}
+
+	s.lockFile = lockFile
+
+	return nil
+}
+
+func (s *Supervisor) unlock() {
+	if s.lockFile == nil {
+		return
+	}
+
+	_ = syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_UN)
+	_ = s.lockFile.Close()
+	s.lockFile = nil
+}
+
+func (s *Supervisor) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return fmt.Errorf("already started")
+	}
+
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	// the server goes first so that it's there to be asked about the services as soon as they're started
+	err = s.server.Start()
+	if err != nil {
+		s.unlock()
+		return err
+	}
+
+	// as for the server, so as not to miss anything
+	err = s.store.Start()
+	if err != nil {
+		_ = s.server.Stop()
+		s.unlock()
+		return err
+	}
+
+	// unless-stopped services that were stopped by hand stay that way across supervisor restarts
+	stopped, err := readStopped(s.stateDir)
+	if err != nil {
+		s.logger.Warn("ignoring stopped file", "error", err)
+		stopped = []string{}
+	}
+
+	s.system.SetManuallyStopped(stopped, func(names []string) {
+		err := writeJSON(s.stateDir, stoppedFileName, names)
+		if err != nil {
+			s.logger.Error("failed to write stopped file", "error", err)
+		}
+	})
+
+	err = s.system.Start()
+	if err != nil {
+		_ = s.store.Stop()
+		_ = s.server.Stop()
+		s.unlock()
+		return err
+	}
+
+	err = writeState(
+		s.stateDir,
+		State{
+			PID:        os.Getpid(),
+			Name:       s.config.Name,
+			ConfigPath: s.configPath,
+			SocketPath: filepath.Join(s.stateDir, socketFileName),
+			StartedAt:  time.Now().UTC(),
+		},
+	)
+	if err != nil {
+		_ = s.server.Stop()
+		_ = s.system.Stop()
+		_ = s.store.Stop()
+		s.unlock()
+		return err
+	}
+
+	s.started = true
+
+	s.logger.Debug("started", "pid", os.Getpid(), "state_dir", s.stateDir)
+
+	return nil
+}
+
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		return fmt.Errorf("not started")
+	}
+
+	_ = s.server.Stop()
+
+	// the system will have already been stopped if we're going down at the request of a client
+	var err error
+	if s.system.Started() {
+		var stopReport *system.StopReport
+
+		stopReport, err = s.system.StopWithTimeout(system.DefaultStopTimeout)
+		if stopReport != nil && len(stopReport.ForceKilled) > 0 {
+			s.logger.Warn("some services had to be killed", "services", stopReport.ForceKilled)
+		}
+	}
+
+	// after the system, so as to catch the last of the logs
+	_ = s.store.Stop()
+
+	_ = os.Remove(filepath.Join(s.stateDir, stateFileName))
+
+	// going down at the request of a client is a clean slate; anything else (e.g. a signal) might be followed by a
+	// restart, for which the manually stopped services are remembered
+	select {
+	case <-s.done:
+		_ = os.Remove(filepath.Join(s.stateDir, stoppedFileName))
+	default:
+	}
+
+	s.unlock()
+
+	s.started = false
+
+	s.logger.Debug("stopped")
+
+	return err
+}
+
+// Done is closed once a client has asked (via the control socket) for the supervisor to go down
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Supervisor) Name() string {
+	return s.config.Name
+}
+
+func (s *Supervisor) ServiceNames() []string {
+	names := make([]string, 0)
+	for name := range s.config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *Supervisor) StateDir() string {
+	return s.stateDir
+}
+
+func (s *Supervisor) System() *system.System {
+	return s.system
+}
+
+// NewClient returns a client for the control socket of the supervisor running the project holding the given service file
+func NewClient(configPath string) (*control.Client, error) {
+	stateDir, err := StateDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := ReadState(stateDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("not running (no live supervisor state in %v)", stateDir)
+		}
+
+		return nil, err
+	}
+
+	return control.NewClient(state.SocketPath), nil
+}
+
+// rotateLog moves the log at the given path aside (to path.1, with path.1 going to path.2 and so on), keeping at most
+// logFilesKept of them, so that each supervisor starts a log of its own
+func rotateLog(path string) error {
+	for i := logFilesKept; i > 0; i-- {
+		from := path
+		if i > 1 {
+			from = fmt.Sprintf("%v.%v", path, i-1)
+		}
+
+		err := os.Rename(from, fmt.Sprintf("%v.%v", path, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Spawn starts a detached supervisor (by re-executing this binary with the given args) and waits for it to write its
+// state; the supervisor's own output goes to a log file in the state dir (with those of the last few supervisors kept
+// alongside)
+func Spawn(configPath string, args []string) (*State, error) {
+	stateDir, err := StateDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := ReadState(stateDir)
+	if err == nil {
+		return nil, fmt.Errorf("already running under supervisor pid %v", state.PID)
+	}
+
+	err = os.MkdirAll(stateDir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	logPath := filepath.Join(stateDir, logFileName)
+
+	err = rotateLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(spawnTimeout)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return nil, fmt.Errorf("supervisor exited during startup; see %v", logPath)
+		case <-time.After(spawnInterval):
+		}
+
+		state, err = ReadState(stateDir)
+		if err == nil && state.PID == cmd.Process.Pid {
+			return state, nil
+		}
+	}
+
+	_ = cmd.Process.Kill()
+
+	return nil, fmt.Errorf("timed out waiting for supervisor to start; see %v", logPath)
+}
@@ -0,0 +1,141 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/logstore"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testConfig = `
+name: supervisor_test
+services:
+  a:
+    command: "while true; do echo 'tick'; sleep 1; done"
+    restart: unless-stopped
+`
+)
+
+func TestNew(t *testing.T) {
+	t.Run("StartWritesStateAndStopRemovesIt", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "dspo.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+
+		s, err := New(path)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, StateDirName), s.StateDir())
+
+		require.NoError(t, s.Start())
+
+		state, err := ReadState(s.StateDir())
+		require.NoError(t, err)
+		require.Equal(t, os.Getpid(), state.PID)
+		require.Equal(t, "supervisor_test", state.Name)
+		require.Equal(t, path, state.ConfigPath)
+
+		other, err := New(path)
+		require.NoError(t, err)
+		require.Error(t, other.Start())
+
+		require.NoError(t, s.Stop())
+
+		_, err = ReadState(s.StateDir())
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("ManualStopRememberedAcrossRestarts", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "dspo.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+
+		s, err := New(path)
+		require.NoError(t, err)
+		require.NoError(t, s.Start())
+		require.NoError(t, s.System().StopService("a"))
+		require.NoError(t, s.Stop())
+
+		// e.g. restarted after a reboot
+		s, err = New(path)
+		require.NoError(t, err)
+		require.NoError(t, s.Start())
+		require.False(t, s.System().ServiceByName()["a"].Started())
+
+		require.NoError(t, s.System().StartService("a"))
+		require.NoError(t, s.Stop())
+
+		s, err = New(path)
+		require.NoError(t, err)
+		require.NoError(t, s.Start())
+		require.True(t, s.System().ServiceByName()["a"].Started())
+		require.NoError(t, s.Stop())
+	})
+
+	t.Run("LogsOutliveTheSupervisor", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "dspo.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+
+		s, err := New(path)
+		require.NoError(t, err)
+		require.NoError(t, s.Start())
+
+		logDir, err := LogDir(path)
+		require.NoError(t, err)
+
+		require.Eventually(
+			t,
+			func() bool {
+				logs, err := logstore.Read(logDir, []string{"a"}, logstore.Query{})
+				return err == nil && len(logs) > 0
+			},
+			time.Second*2,
+			time.Millisecond*50,
+		)
+
+		require.NoError(t, s.Stop())
+
+		logs, err := logstore.Read(logDir, nil, logstore.Query{})
+		require.NoError(t, err)
+		require.NotEmpty(t, logs)
+		require.Equal(t, "a", logs[0].Name)
+		require.Equal(t, "tick\n", string(logs[0].Data))
+	})
+
+	t.Run("StaleState", func(t *testing.T) {
+		dir := t.TempDir()
+
+		require.NoError(t, writeState(dir, State{PID: -1, Name: "stale"}))
+
+		_, err := ReadState(dir)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("RotateLog", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), logFileName)
+
+		// nothing to rotate the first time around
+		require.NoError(t, rotateLog(logPath))
+
+		for i := 0; i < logFilesKept+2; i++ {
+			require.NoError(t, os.WriteFile(logPath, []byte(fmt.Sprintf("supervisor %v\n", i)), 0o644))
+			require.NoError(t, rotateLog(logPath))
+		}
+
+		_, err := os.Stat(logPath)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		for i := 1; i <= logFilesKept; i++ {
+			b, err := os.ReadFile(fmt.Sprintf("%v.%v", logPath, i))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("supervisor %v\n", logFilesKept+2-i), string(b))
+		}
+
+		_, err = os.Stat(fmt.Sprintf("%v.%v", logPath, logFilesKept+1))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -3,30 +3,48 @@ package system
 import (
 	"fmt"
 	"log/slog"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/initialed85/dspo/internal"
 	"github.com/initialed85/dspo/pkg/common"
 	_fanin "github.com/initialed85/dspo/pkg/fanin"
 	_fanout "github.com/initialed85/dspo/pkg/fanout"
 	"github.com/initialed85/dspo/pkg/managed_process"
+	"github.com/initialed85/dspo/pkg/process"
 	"github.com/initialed85/dspo/pkg/service"
 )
 
 const (
 	depth = 65536
+	// how many of the most recent logs to keep for each service, for subscribers that turn up late
+	replayDepth = 4096
+	// DefaultStopTimeout bounds the time taken by Stop across all services
+	DefaultStopTimeout = time.Second * 30
+	killWaitDuration   = time.Second * 5
 )
 
 type System struct {
-	serviceArgs   []common.ServiceArgs
-	name          string
-	mu            *sync.Mutex
-	started       bool
-	serviceByName map[string]*service.Service
-	logger        *slog.Logger
-	consumer      chan managed_process.Log
-	fanin         *_fanin.Fanin
-	fanout        *_fanout.Fanout
+	serviceArgs       []common.ServiceArgs
+	name              string
+	mu                *sync.Mutex
+	started           bool
+	serviceByName     map[string]*service.Service
+	logger            *slog.Logger
+	consumer          chan managed_process.Log
+	fanin             *_fanin.LogFanin
+	fanout            *_fanout.LogFanout
+	logsMu            *sync.Mutex
+	unsubscribeByName map[string]func()
+	stopping          atomic.Bool
+	// services stopped by hand (as opposed to by Stop), which unless-stopped services remember across restarts
+	manuallyStoppedMu       *sync.Mutex
+	manuallyStoppedByName   map[string]bool
+	onManuallyStoppedChange func([]string)
 }
 
 func New(
@@ -34,20 +52,129 @@ func New(
 	name string,
 ) *System {
 	s := System{
-		serviceArgs:   serviceArgs,
-		mu:            new(sync.Mutex),
-		started:       false,
-		serviceByName: make(map[string]*service.Service),
-		logger:        internal.GetLogger(name),
-		consumer:      make(chan managed_process.Log, depth),
+		serviceArgs:             serviceArgs,
+		mu:                      new(sync.Mutex),
+		started:                 false,
+		serviceByName:           make(map[string]*service.Service),
+		logger:                  internal.GetLogger(name),
+		consumer:                make(chan managed_process.Log, depth),
+		logsMu:                  new(sync.Mutex),
+		unsubscribeByName:       make(map[string]func()),
+		manuallyStoppedMu:       new(sync.Mutex),
+		manuallyStoppedByName:   make(map[string]bool),
+		onManuallyStoppedChange: func([]string) {},
 	}
 
 	s.fanin = _fanin.New(s.consumer)
-	s.fanout = _fanout.New(s.consumer)
+	s.fanout = _fanout.NewLogFanout(s.consumer, replayDepth)
 
 	return &s
 }
 
+// SetManuallyStopped restores the services that had been stopped by hand (e.g. before a supervisor restart) and sets a
+// func to be called with the (sorted) names whenever that changes, so that it can be persisted; it should be called
+// before Start, which leaves any of the given services with the unless-stopped restart policy stopped
+func (s *System) SetManuallyStopped(names []string, onChange func([]string)) {
+	s.manuallyStoppedMu.Lock()
+	defer s.manuallyStoppedMu.Unlock()
+
+	s.manuallyStoppedByName = make(map[string]bool)
+	for _, name := range names {
+		s.manuallyStoppedByName[name] = true
+	}
+
+	if onChange != nil {
+		s.onManuallyStoppedChange = onChange
+	}
+}
+
+// ManuallyStopped returns the (sorted) names of the services that have been stopped by hand
+func (s *System) ManuallyStopped() []string {
+	s.manuallyStoppedMu.Lock()
+	defer s.manuallyStoppedMu.Unlock()
+
+	return s.getManuallyStopped()
+}
+
+// getManuallyStopped expects manuallyStoppedMu to be held
+func (s *System) getManuallyStopped() []string {
+	names := make([]string, 0)
+	for name := range s.manuallyStoppedByName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *System) setManuallyStopped(name string, manuallyStopped bool) {
+	s.manuallyStoppedMu.Lock()
+	defer s.manuallyStoppedMu.Unlock()
+
+	if s.manuallyStoppedByName[name] == manuallyStopped {
+		return
+	}
+
+	if manuallyStopped {
+		s.manuallyStoppedByName[name] = true
+	} else {
+		delete(s.manuallyStoppedByName, name)
+	}
+
+	s.onManuallyStoppedChange(s.getManuallyStopped())
+}
+
+// skipStart reports whether the given service should be left stopped on start
+func (s *System) skipStart(serviceArgs common.ServiceArgs) bool {
+	if serviceArgs.ManagedProcessArgs.RestartPolicy != managed_process.UnlessStopped {
+		return false
+	}
+
+	s.manuallyStoppedMu.Lock()
+	defer s.manuallyStoppedMu.Unlock()
+
+	return s.manuallyStoppedByName[serviceArgs.Name]
+}
+
+// consumeLogs wires the given service's logs into the system fanin, replacing any previous subscription for it; it's
+// called before the service is started so that nothing is missed, and it blocks rather than drops, leaving it to the
+// subscribers to the system to decide what to do if they're not keeping up; a service's logs are held back until it's
+// ready
+func (s *System) consumeLogs(actualService *service.Service) {
+	consumer, unsubscribe, err := actualService.SubscribeToReadyLogs()
+	if err != nil {
+		s.logger.Error(
+			"unexpectedly failed to subscribe to logs for service",
+			"service", actualService.Name(),
+			"error", err,
+		)
+		return
+	}
+
+	wrappedUnsubscribe := s.fanin.Consume(consumer, unsubscribe)
+
+	s.logsMu.Lock()
+	previousUnsubscribe := s.unsubscribeByName[actualService.Name()]
+	s.unsubscribeByName[actualService.Name()] = wrappedUnsubscribe
+	s.logsMu.Unlock()
+
+	if previousUnsubscribe != nil {
+		previousUnsubscribe()
+	}
+}
+
+func (s *System) unconsumeLogs(actualService *service.Service) {
+	s.logsMu.Lock()
+	unsubscribe := s.unsubscribeByName[actualService.Name()]
+	delete(s.unsubscribeByName, actualService.Name())
+	s.logsMu.Unlock()
+
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+}
+
 func (s *System) Start() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -56,6 +183,8 @@ func (s *System) Start() error {
 		return fmt.Errorf("cannot start, already running")
 	}
 
+	s.stopping.Store(false)
+
 	//
 	// sanity check for duplicates or unknown dependencies
 	//
@@ -71,6 +200,38 @@ func (s *System) Start() error {
 		serviceArgsByName[serviceArgs.Name] = serviceArgs
 	}
 
+	//
+	// sanity check that the processes can be run as described (working dir, user, etc)
+	//
+
+	for _, serviceArgs := range s.serviceArgs {
+		err := serviceArgs.ManagedProcessArgs.Attributes.Validate()
+		if err != nil {
+			return fmt.Errorf("service %#+v: %v", serviceArgs.Name, err)
+		}
+
+		if serviceArgs.StartupProbeArgs != nil {
+			err = serviceArgs.StartupProbeArgs.Attributes.Validate()
+			if err != nil {
+				return fmt.Errorf("service %#+v startup probe: %v", serviceArgs.Name, err)
+			}
+		}
+
+		if serviceArgs.LivenessProbeArgs != nil {
+			err = serviceArgs.LivenessProbeArgs.Attributes.Validate()
+			if err != nil {
+				return fmt.Errorf("service %#+v liveness probe: %v", serviceArgs.Name, err)
+			}
+		}
+
+		if serviceArgs.ReadinessProbeArgs != nil {
+			err = serviceArgs.ReadinessProbeArgs.Attributes.Validate()
+			if err != nil {
+				return fmt.Errorf("service %#+v readiness probe: %v", serviceArgs.Name, err)
+			}
+		}
+	}
+
 	for _, serviceArgs := range serviceArgsByName {
 		if serviceArgs.DependsOn == nil {
 			continue
@@ -98,6 +259,11 @@ func (s *System) Start() error {
 	nonRootServicesByDependsOnName := make(map[string][]*service.Service)
 	handledServiceByName := make(map[string]*service.Service)
 
+	// tracked here rather than asked of each service, as the callbacks below run with the ready service's lock held
+	readyMu := new(sync.Mutex)
+	startupReadyByName := make(map[string]bool)
+	startingByName := make(map[string]bool)
+
 	// shouldn't be more layers than there are services (would a real graph be better? yes, yes it would)
 	for i := 0; i < len(serviceArgsByName); i++ {
 		for name, serviceArgs := range unhandledServiceArgsByName {
@@ -127,30 +293,60 @@ func (s *System) Start() error {
 				serviceArgs.ManagedProcessArgs,
 				serviceArgs.StartupProbeArgs,
 				serviceArgs.LivenessProbeArgs,
+				serviceArgs.ReadinessProbeArgs,
 				func() {
+					// don't start anything while we're being torn down
+					if s.stopping.Load() {
+						return
+					}
+
+					readyMu.Lock()
+					startupReadyByName[name] = true
+					readyMu.Unlock()
+
 					nonRootServices, ok := nonRootServicesByDependsOnName[serviceArgs.Name]
 					if !ok {
 						return
 					}
 
+					readyNonRootServices := make([]*service.Service, 0)
+
+					readyMu.Lock()
 					for _, nonRootService := range nonRootServices {
-						s.logger.Debug(
-							fmt.Sprintf("%v starting non-root service %v", name, nonRootService.Name()),
-						)
+						if startingByName[nonRootService.Name()] {
+							continue
+						}
 
-						_ = nonRootService.Start()
+						foundAllDependencies := true
+						for _, dependsOn := range serviceArgsByName[nonRootService.Name()].DependsOn {
+							if !startupReadyByName[dependsOn] {
+								foundAllDependencies = false
+								break
+							}
+						}
 
-						consumer, unsubscribe, err := nonRootService.SubscribeToLogs()
-						if err != nil {
-							s.logger.Error(
-								"unexpectedly failed to subscribe to logs for service",
-								"service", nonRootService.Name(),
-								"error", err,
-							)
+						if !foundAllDependencies {
 							continue
 						}
 
-						s.fanin.Consume(consumer, unsubscribe)
+						startingByName[nonRootService.Name()] = true
+						readyNonRootServices = append(readyNonRootServices, nonRootService)
+					}
+					readyMu.Unlock()
+
+					for _, nonRootService := range readyNonRootServices {
+						if s.skipStart(serviceArgsByName[nonRootService.Name()]) {
+							s.logger.Info(fmt.Sprintf("leaving manually stopped service %v stopped", nonRootService.Name()))
+							continue
+						}
+
+						s.logger.Debug(
+							fmt.Sprintf("%v starting non-root service %v", name, nonRootService.Name()),
+						)
+
+						s.consumeLogs(nonRootService)
+
+						_ = nonRootService.Start()
 					}
 				},
 				common.NoOpFunc,
@@ -191,21 +387,16 @@ func (s *System) Start() error {
 	//
 
 	for _, actualService := range rootServiceByName {
-		s.logger.Debug(fmt.Sprintf("starting root service %v", actualService.Name()))
-
-		_ = actualService.Start()
-
-		consumer, unsubscribe, err := actualService.SubscribeToLogs()
-		if err != nil {
-			s.logger.Error(
-				"unexpectedly failed to subscribe to logs for service",
-				"service", actualService.Name(),
-				"error", err,
-			)
+		if s.skipStart(serviceArgsByName[actualService.Name()]) {
+			s.logger.Info(fmt.Sprintf("leaving manually stopped service %v stopped", actualService.Name()))
 			continue
 		}
 
-		s.fanin.Consume(consumer, unsubscribe)
+		s.logger.Debug(fmt.Sprintf("starting root service %v", actualService.Name()))
+
+		s.consumeLogs(actualService)
+
+		_ = actualService.Start()
 	}
 
 	s.serviceByName = handledServiceByName
@@ -215,28 +406,259 @@ func (s *System) Start() error {
 	return nil
 }
 
+// StopReport describes how a system was stopped
+type StopReport struct {
+	// Tiers holds the names of the services that were stopped together, in the order they were stopped (dependents
+	// before their dependencies)
+	Tiers [][]string `json:"tiers"`
+	// ForceKilled holds the names of the services that had to be killed, either because they outlived their stop grace
+	// period or because they hadn't stopped before the timeout
+	ForceKilled []string `json:"force_killed"`
+}
+
+// getStopTiers groups the services by their depth in the dependency graph, deepest first; everything in a tier can be
+// stopped at once, as nothing in a tier depends on anything in the same tier or in the tiers before it
+func (s *System) getStopTiers() [][]*service.Service {
+	dependsOnByName := make(map[string][]string)
+	for _, serviceArgs := range s.serviceArgs {
+		dependsOnByName[serviceArgs.Name] = serviceArgs.DependsOn
+	}
+
+	depthByName := make(map[string]int)
+
+	var getDepth func(name string) int
+	getDepth = func(name string) int {
+		depth, ok := depthByName[name]
+		if ok {
+			return depth
+		}
+
+		depth = 0
+		for _, dependsOn := range dependsOnByName[name] {
+			dependsOnDepth := getDepth(dependsOn) + 1
+			if dependsOnDepth > depth {
+				depth = dependsOnDepth
+			}
+		}
+
+		depthByName[name] = depth
+
+		return depth
+	}
+
+	maxDepth := -1
+	for name := range s.serviceByName {
+		depth := getDepth(name)
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+
+	tiers := make([][]*service.Service, 0)
+
+	for depth := maxDepth; depth >= 0; depth-- {
+		tier := make([]*service.Service, 0)
+
+		for name, actualService := range s.serviceByName {
+			if depthByName[name] == depth {
+				tier = append(tier, actualService)
+			}
+		}
+
+		sort.Slice(tier, func(i, j int) bool {
+			return tier[i].Name() < tier[j].Name()
+		})
+
+		tiers = append(tiers, tier)
+	}
+
+	return tiers
+}
+
+// stopTier stops the given services concurrently, killing any that are still going at the deadline; it returns the
+// names of the services that had to be killed (including those killed for outliving their stop grace period)
+func (s *System) stopTier(tier []*service.Service, deadline time.Time) []string {
+	stopped := make(chan string, len(tier))
+	stoppingByName := make(map[string]*service.Service)
+
+	for _, actualService := range tier {
+		actualService := actualService
+
+		// already stopped services are still waited on (briefly) to keep things simple
+		stoppingByName[actualService.Name()] = actualService
+
+		go func() {
+			_ = actualService.Stop()
+			stopped <- actualService.Name()
+		}()
+	}
+
+	forceKilled := make([]string, 0)
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	for len(stoppingByName) > 0 {
+		select {
+		case name := <-stopped:
+			delete(stoppingByName, name)
+		case <-timeout.C:
+			for name, actualService := range stoppingByName {
+				s.logger.Warn(fmt.Sprintf("timed out waiting for service %v to stop; killing it", name))
+				actualService.Kill()
+				forceKilled = append(forceKilled, name)
+			}
+
+			// a killed process should go quickly, but don't wait forever for one that's stuck
+			killTimeout := time.After(killWaitDuration)
+			for len(stoppingByName) > 0 {
+				select {
+				case name := <-stopped:
+					delete(stoppingByName, name)
+				case <-killTimeout:
+					for name := range stoppingByName {
+						s.logger.Error(fmt.Sprintf("gave up waiting for service %v to die", name))
+					}
+					stoppingByName = make(map[string]*service.Service)
+				}
+			}
+		}
+	}
+
+	for _, actualService := range tier {
+		if actualService.StopOutcome() != process.Killed {
+			continue
+		}
+
+		if slices.Contains(forceKilled, actualService.Name()) {
+			continue
+		}
+
+		forceKilled = append(forceKilled, actualService.Name())
+	}
+
+	sort.Strings(forceKilled)
+
+	return forceKilled
+}
+
 func (s *System) Stop() error {
+	_, err := s.StopWithTimeout(DefaultStopTimeout)
+
+	return err
+}
+
+// StopWithTimeout stops the services in reverse dependency order, waiting for each tier to stop before moving on to the
+// next; any service still going once the timeout has elapsed is killed
+func (s *System) StopWithTimeout(timeout time.Duration) (*StopReport, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if !s.started {
-		return fmt.Errorf("cannot stop, not running")
+		return nil, fmt.Errorf("cannot stop, not running")
 	}
 
 	s.started = false
+	s.stopping.Store(true)
 
-	for _, actualService := range s.serviceByName {
-		_ = actualService.Stop()
+	deadline := time.Now().Add(timeout)
+
+	report := StopReport{
+		Tiers:       make([][]string, 0),
+		ForceKilled: make([]string, 0),
+	}
+
+	for _, tier := range s.getStopTiers() {
+		names := make([]string, 0)
+		for _, actualService := range tier {
+			names = append(names, actualService.Name())
+		}
+
+		s.logger.Debug(fmt.Sprintf("stopping services %v", strings.Join(names, ", ")))
+
+		report.Tiers = append(report.Tiers, names)
+		report.ForceKilled = append(report.ForceKilled, s.stopTier(tier, deadline)...)
 	}
 
 	s.serviceByName = make(map[string]*service.Service)
 
+	s.logsMu.Lock()
+	s.unsubscribeByName = make(map[string]func())
+	s.logsMu.Unlock()
+
 	s.fanout.Close()
 	s.fanin.Close()
 
+	return &report, nil
+}
+
+func (s *System) getService(name string) (*service.Service, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		return nil, fmt.Errorf("not running")
+	}
+
+	actualService, ok := s.serviceByName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %#+v", name)
+	}
+
+	return actualService, nil
+}
+
+// StartService starts a single (previously stopped) service, regardless of the state of its dependencies
+func (s *System) StartService(name string) error {
+	actualService, err := s.getService(name)
+	if err != nil {
+		return err
+	}
+
+	s.consumeLogs(actualService)
+
+	err = actualService.Start()
+	if err != nil {
+		s.unconsumeLogs(actualService)
+		return fmt.Errorf("cannot start %#+v: %v", name, err)
+	}
+
+	s.setManuallyStopped(name, false)
+
+	s.logger.Debug(fmt.Sprintf("started service %v", name))
+
+	return nil
+}
+
+// StopService stops a single service, leaving its dependents running; the service is remembered as manually stopped
+// until it's started again
+func (s *System) StopService(name string) error {
+	actualService, err := s.getService(name)
+	if err != nil {
+		return err
+	}
+
+	// the logs are consumed until it's stopped, so that nothing it has to say while stopping is lost
+	err = actualService.Stop()
+	s.unconsumeLogs(actualService)
+	if err != nil {
+		return fmt.Errorf("cannot stop %#+v: %v", name, err)
+	}
+
+	s.setManuallyStopped(name, true)
+
+	s.logger.Debug(fmt.Sprintf("stopped service %v", name))
+
 	return nil
 }
 
+func (s *System) Started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.started
+}
+
 func (s *System) ServiceByName() map[string]*service.Service {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -250,7 +672,30 @@ func (s *System) ServiceByName() map[string]*service.Service {
 	return serviceByName
 }
 
+// CrashLooping returns the (sorted) names of the services that are crash looping
+func (s *System) CrashLooping() []string {
+	names := make([]string, 0)
+
+	for name, actualService := range s.ServiceByName() {
+		if actualService.CrashLooping() {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// SubscribeToLogs subscribes to the logs for all services with the default policy (drop-newest)
 func (s *System) SubscribeToLogs() (chan managed_process.Log, func(), error) {
+	return s.SubscribeToLogsWithPolicy(_fanout.DropNewest)
+}
+
+// SubscribeToLogsWithPolicy subscribes to the logs for all services with the given policy for when the subscriber
+// isn't keeping up; block and spill-to-disk never lose a log, but a blocked subscriber holds up every other subscriber
+// and ultimately the services themselves
+func (s *System) SubscribeToLogsWithPolicy(policy _fanout.Policy) (chan managed_process.Log, func(), error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -258,7 +703,31 @@ func (s *System) SubscribeToLogs() (chan managed_process.Log, func(), error) {
 		return nil, nil, fmt.Errorf("no fanout to subscribe to (not started?)")
 	}
 
-	logs, cancel := s.fanout.Subscribe()
+	return s.fanout.SubscribeWithPolicy(policy)
+}
+
+// SubscribeToLogsWithReplay subscribes to the logs for all services as for SubscribeToLogsWithPolicy, returning the
+// recent logs described by the given replay as well (with no gap or overlap between those and the live logs)
+func (s *System) SubscribeToLogsWithReplay(
+	policy _fanout.Policy,
+	replay _fanout.Replay,
+) ([]managed_process.Log, chan managed_process.Log, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fanout == nil {
+		return nil, nil, nil, fmt.Errorf("no fanout to subscribe to (not started?)")
+	}
+
+	return s.fanout.SubscribeWithReplay(policy, replay)
+}
+
+// ReplayLogs returns the recent logs for all services described by the given replay
+func (s *System) ReplayLogs(replay _fanout.Replay) []managed_process.Log {
+	return s.fanout.Replay(replay)
+}
 
-	return logs, cancel, nil
+// DroppedLogs returns the number of logs dropped for subscribers that weren't keeping up
+func (s *System) DroppedLogs() uint64 {
+	return s.fanout.Dropped()
 }
@@ -2,11 +2,16 @@ package system
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/initialed85/dspo/pkg/common"
+	"github.com/initialed85/dspo/pkg/fanout"
+	"github.com/initialed85/dspo/pkg/managed_process"
 	"github.com/initialed85/dspo/test"
 	"github.com/stretchr/testify/require"
 )
@@ -96,4 +101,212 @@ func TestNew(t *testing.T) {
 		require.Eventually(t, service4.StartupReady, time.Second*1, time.Millisecond*50)
 		require.Eventually(t, service4.LivenessReady, time.Second*1, time.Millisecond*50)
 	})
+
+	t.Run("StopInReverseDependencyOrder", func(t *testing.T) {
+		getServiceArgs := func(name string, dependsOn []string) common.ServiceArgs {
+			return common.ServiceArgs{
+				Name:      name,
+				DependsOn: dependsOn,
+				ManagedProcessArgs: common.ManagedProcessArgs{
+					RestartPolicy:       managed_process.UnlessStopped,
+					Shell:               "/bin/bash",
+					Command:             "while true; do echo 'tick'; sleep 1; done",
+					InheritEnv:          true,
+					RestartWaitDuration: time.Millisecond * 50,
+				},
+			}
+		}
+
+		s := New(
+			[]common.ServiceArgs{
+				getServiceArgs("service_1a", []string{}),
+				getServiceArgs("service_1b", []string{}),
+				getServiceArgs("service_2", []string{"service_1b"}),
+				getServiceArgs("service_3a", []string{"service_2"}),
+				getServiceArgs("service_3b", []string{"service_2", "service_1a"}),
+				getServiceArgs("service_4", []string{"service_3a", "service_1a"}),
+			},
+			"test",
+		)
+		require.NoError(t, s.Start())
+
+		for _, actualService := range s.ServiceByName() {
+			require.Eventually(t, actualService.Started, time.Second*1, time.Millisecond*50)
+		}
+
+		stopReport, err := s.StopWithTimeout(time.Second * 5)
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			&StopReport{
+				Tiers: [][]string{
+					{"service_4"},
+					{"service_3a", "service_3b"},
+					{"service_2"},
+					{"service_1a", "service_1b"},
+				},
+				ForceKilled: []string{},
+			},
+			stopReport,
+		)
+
+		_, err = s.StopWithTimeout(time.Second * 5)
+		require.Error(t, err)
+	})
+
+	t.Run("StartFailsForMissingWorkingDir", func(t *testing.T) {
+		serviceArgs := test.NewMockService("service_1", []string{})
+		serviceArgs.ServiceArgs.ManagedProcessArgs.Attributes.WorkingDir = "/does/not/exist"
+
+		s := New(
+			[]common.ServiceArgs{
+				serviceArgs.ServiceArgs,
+			},
+			"test",
+		)
+
+		err := s.Start()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "/does/not/exist")
+		require.False(t, s.Started())
+	})
+
+	t.Run("LosslessLogs", func(t *testing.T) {
+		s := New(
+			[]common.ServiceArgs{
+				{
+					Name: "service_1",
+					ManagedProcessArgs: common.ManagedProcessArgs{
+						RestartPolicy: managed_process.Never,
+						Shell:         "/bin/bash",
+						Command:       "seq 1 20000",
+					},
+				},
+			},
+			"test",
+		)
+
+		// subscribed before starting, so as not to miss anything
+		consumer, unsubscribe, err := s.SubscribeToLogsWithPolicy(fanout.Block)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		// a subscriber that never reads anything shouldn't hold anything up
+		_, unsubscribeIdle, err := s.SubscribeToLogs()
+		require.NoError(t, err)
+		defer unsubscribeIdle()
+
+		require.NoError(t, s.Start())
+		defer func() {
+			require.NoError(t, s.Stop())
+		}()
+
+		for i := 1; i <= 20000; i++ {
+			select {
+			case l := <-consumer:
+				require.Equal(t, fmt.Sprintf("%v\n", i), string(l.Data))
+			case <-time.After(time.Second * 5):
+				require.FailNow(t, "timed out waiting for logs", "got %v/20000", i-1)
+			}
+
+			// a slow subscriber, at least some of the time
+			if i%5000 == 0 {
+				time.Sleep(time.Millisecond * 100)
+			}
+		}
+
+		require.Greater(t, s.DroppedLogs(), uint64(0))
+	})
+	t.Run("StopServiceKeepsShutdownLogs", func(t *testing.T) {
+		s := New(
+			[]common.ServiceArgs{
+				{
+					Name: "service_1",
+					ManagedProcessArgs: common.ManagedProcessArgs{
+						RestartPolicy:   managed_process.Never,
+						Shell:           "/bin/bash",
+						Command:         "trap 'echo stopping; exit 0' TERM; echo started; while true; do sleep 0.1; done",
+						StopGracePeriod: time.Second * 5,
+					},
+				},
+			},
+			"test",
+		)
+
+		consumer, unsubscribe, err := s.SubscribeToLogsWithPolicy(fanout.Block)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		waitForLine := func(line string) {
+			for {
+				select {
+				case l := <-consumer:
+					if string(l.Data) == line {
+						return
+					}
+				case <-time.After(time.Second * 5):
+					require.FailNow(t, "timed out waiting for logs", "wanted %#+v", line)
+				}
+			}
+		}
+
+		waitForLine("started\n")
+
+		require.NoError(t, s.StopService("service_1"))
+
+		waitForLine("stopping\n")
+	})
+
+	t.Run("LogsHeldBackUntilReady", func(t *testing.T) {
+		readyPath := filepath.Join(t.TempDir(), "ready")
+
+		s := New(
+			[]common.ServiceArgs{
+				{
+					Name: "service_1",
+					ManagedProcessArgs: common.ManagedProcessArgs{
+						RestartPolicy: managed_process.Never,
+						Shell:         "/bin/bash",
+						Command:       "for i in $(seq 1 3); do echo \"line $i\"; done; sleep 30",
+					},
+					ReadinessProbeArgs: &common.ReadinessProbeArgs{
+						ProbeInterval: time.Millisecond * 50,
+						Command:       fmt.Sprintf("test -f %v", readyPath),
+					},
+				},
+			},
+			"test",
+		)
+
+		consumer, unsubscribe, err := s.SubscribeToLogsWithPolicy(fanout.Block)
+		require.NoError(t, err)
+		defer unsubscribe()
+
+		require.NoError(t, s.Start())
+		defer func() {
+			_ = s.Stop()
+		}()
+
+		select {
+		case l := <-consumer:
+			require.FailNow(t, "got logs before the service was ready", "%#+v", string(l.Data))
+		case <-time.After(time.Millisecond * 500):
+		}
+
+		require.NoError(t, os.WriteFile(readyPath, []byte{}, 0o644))
+
+		for i := 1; i <= 3; i++ {
+			select {
+			case l := <-consumer:
+				require.Equal(t, fmt.Sprintf("line %v\n", i), string(l.Data))
+			case <-time.After(time.Second * 5):
+				require.FailNow(t, "timed out waiting for logs", "got %v/3", i-1)
+			}
+		}
+	})
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/initialed85/dspo/pkg/control"
+	"github.com/initialed85/dspo/pkg/probe"
+	"github.com/initialed85/dspo/pkg/supervisor"
+)
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// status sums up the state of a service in a word or two, worst first
+func status(serviceStatus control.ServiceStatus) string {
+	switch {
+	case serviceStatus.Failed:
+		return "failed"
+	case serviceStatus.CrashLooping:
+		return "crash-loop-backoff"
+	case serviceStatus.Running:
+		return "running"
+	case serviceStatus.Started:
+		return "exited"
+	}
+
+	return "stopped"
+}
+
+// lastExit describes the most recent run of a service to have ended
+func lastExit(serviceStatus control.ServiceStatus, now time.Time) string {
+	for i := len(serviceStatus.History) - 1; i >= 0; i-- {
+		run := serviceStatus.History[i]
+		if !run.Ended() {
+			continue
+		}
+
+		description := fmt.Sprintf("exit %v", run.ExitCode)
+
+		if run.Error != "" {
+			description = "failed to start"
+		} else if run.Signal != 0 {
+			description = fmt.Sprintf("signal %v (%v)", run.Signal, syscall.Signal(run.Signal))
+		}
+
+		if run.Stopped {
+			description += ", stopped"
+		}
+
+		if run.OOMKilled {
+			description += ", oom killed?"
+		}
+
+		return fmt.Sprintf("%v, %v ago", description, now.Sub(run.EndedAt).Round(time.Second))
+	}
+
+	return "-"
+}
+
+// lastProbeFailure describes the most recent failed attempt by any of a service's probes (e.g. whether it timed out or
+// exited non-zero)
+func lastProbeFailure(serviceStatus control.ServiceStatus, now time.Time) string {
+	var last *probe.Result
+	lastName := ""
+
+	for name, results := range map[string][]probe.Result{
+		"startup":   serviceStatus.ProbeHistory.Startup,
+		"liveness":  serviceStatus.ProbeHistory.Liveness,
+		"readiness": serviceStatus.ProbeHistory.Readiness,
+	} {
+		for i := len(results) - 1; i >= 0; i-- {
+			if results[i].OK {
+				continue
+			}
+
+			if last == nil || results[i].At.After(last.At) {
+				last = &results[i]
+				lastName = name
+			}
+
+			break
+		}
+	}
+
+	if last == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%v: %v, %v ago", lastName, last.Error, now.Sub(last.At).Round(time.Second))
+}
+
+func ps(path string, args []string) error {
+	flags := flag.NewFlagSet("ps", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	client, err := supervisor.NewClient(path)
+	if err != nil {
+		return err
+	}
+
+	serviceStatuses, err := client.Services()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(
+		w,
+		"NAME\tSTATUS\tSTARTUP READY\tLIVENESS READY\tREADINESS READY\tRESTARTS\tLAST EXIT\tLAST PROBE FAILURE",
+	)
+
+	now := time.Now()
+
+	for _, serviceStatus := range serviceStatuses {
+		_, _ = fmt.Fprintf(
+			w,
+			"%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			serviceStatus.Name,
+			status(serviceStatus),
+			yesNo(serviceStatus.StartupReady),
+			yesNo(serviceStatus.LivenessReady),
+			yesNo(serviceStatus.ReadinessReady),
+			serviceStatus.Restarts,
+			lastExit(serviceStatus, now),
+			lastProbeFailure(serviceStatus, now),
+		)
+	}
+
+	return w.Flush()
+}
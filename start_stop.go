@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/initialed85/dspo/pkg/control"
+	"github.com/initialed85/dspo/pkg/supervisor"
+)
+
+func parseServiceVerb(path string, verb string, args []string) (*control.Client, []string, error) {
+	flags := flag.NewFlagSet(verb, flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return nil, nil, fmt.Errorf("usage: dspo [-f path] %v service [service ...]", verb)
+	}
+
+	client, err := supervisor.NewClient(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, flags.Args(), nil
+}
+
+func start(path string, args []string) error {
+	client, names, err := parseServiceVerb(path, "start", args)
+	if err != nil {
+		return err
+	}
+
+	return client.Start(names...)
+}
+
+func stop(path string, args []string) error {
+	client, names, err := parseServiceVerb(path, "stop", args)
+	if err != nil {
+		return err
+	}
+
+	return client.Stop(names...)
+}
+
+func restart(path string, args []string) error {
+	client, names, err := parseServiceVerb(path, "restart", args)
+	if err != nil {
+		return err
+	}
+
+	serviceStatuses, err := client.Services()
+	if err != nil {
+		return err
+	}
+
+	startedByName := make(map[string]bool)
+	for _, serviceStatus := range serviceStatuses {
+		startedByName[serviceStatus.Name] = serviceStatus.Started
+	}
+
+	// anything that's already stopped just gets started
+	startedNames := make([]string, 0)
+	for _, name := range names {
+		if startedByName[name] {
+			startedNames = append(startedNames, name)
+		}
+	}
+
+	if len(startedNames) > 0 {
+		err = client.Stop(startedNames...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return client.Start(names...)
+}
@@ -44,6 +44,7 @@ func NewProbeHarness(name string) *ProbeHarness {
 		fmt.Sprintf("chmod +x /tmp/%v_probe_test.sh", p.name),
 		nil,
 		false,
+		process.Attributes{},
 		nil,
 		nil,
 	)
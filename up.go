@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/initialed85/dspo/internal"
+	"github.com/initialed85/dspo/pkg/supervisor"
+)
+
+func up(path string, args []string) error {
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	detach := flags.Bool("d", false, "detach; run the services under a background supervisor")
+	_ = flags.Parse(args)
+
+	if *detach {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		state, err := supervisor.Spawn(
+			absPath,
+			[]string{
+				"-f", absPath,
+				"-log-format", internal.GetFormat(),
+				"-log-level", internal.GetLevel(),
+				"supervise",
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		_, _ = fmt.Fprintf(os.Stdout, "started %v (supervisor pid %v)\n", state.Name, state.PID)
+
+		return nil
+	}
+
+	return runSupervisor(path, true)
+}
+
+// supervise is the entrypoint for the detached supervisor spawned by up -d
+func supervise(path string, args []string) error {
+	flags := flag.NewFlagSet("supervise", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	// the terminal that spawned us may go away
+	signal.Ignore(syscall.SIGHUP)
+
+	return runSupervisor(path, false)
+}
+
+func runSupervisor(path string, follow bool) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	s, err := supervisor.New(path)
+	if err != nil {
+		return err
+	}
+
+	printer := newLogPrinter(os.Stdout, s.ServiceNames(), !isTerminal(os.Stdout))
+
+	logs, unsubscribe, err := s.System().SubscribeToLogs()
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return s.Stop()
+		case <-s.Done():
+			return s.Stop()
+		case l := <-logs:
+			if follow {
+				printer.print(l)
+			}
+		}
+	}
+}